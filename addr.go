@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/net/proxy"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+)
+
+const unixPrefix = "unix:"
+
+// splitAddr returns the network and address of addr, addresses prefixed
+// with unix: are unix domain socket paths
+func splitAddr(addr string) (network, address string) {
+	if strings.HasPrefix(addr, unixPrefix) {
+		return "unix", strings.TrimPrefix(addr, unixPrefix)
+	}
+	return "tcp", addr
+}
+
+// dialVia connects to a tcp address through d, unix: addresses are dialed
+// directly
+func dialVia(d proxy.Dialer, addr string) (net.Conn, error) {
+	network, address := splitAddr(addr)
+	if network == "unix" {
+		return net.Dial(network, address)
+	}
+	return d.Dial(network, address)
+}
+
+// listen listens on a tcp or unix: address, a stale socket file left by a
+// previous process is removed, and mode is applied to new socket files
+// unless it is zero
+func listen(addr string, mode os.FileMode) (net.Listener, error) {
+	network, address := splitAddr(addr)
+	if network != "unix" {
+		return net.Listen(network, address)
+	}
+
+	if err := removeStaleSocket(address); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		if err := os.Chmod(address, mode); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
+
+// removeStaleSocket removes the socket file at path if nothing is listening on it
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return err
+	}
+	return os.Remove(path)
+}
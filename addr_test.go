@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSplitAddr(t *testing.T) {
+	for addr, want := range map[string][2]string{
+		"127.0.0.1:80":       {"tcp", "127.0.0.1:80"},
+		"unix:/run/app.sock": {"unix", "/run/app.sock"},
+		"unix:relative.sock": {"unix", "relative.sock"},
+		"[::1]:8443":         {"tcp", "[::1]:8443"},
+	} {
+		if network, address := splitAddr(addr); network != want[0] || address != want[1] {
+			t.Errorf("splitAddr(%q) = %s %s, want %s %s", addr, network, address, want[0], want[1])
+		}
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "s.sock")
+
+	// A socket file left behind by a dead process is replaced
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := listen(unixPrefix+path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("socket mode = %v, %v", fi.Mode().Perm(), err)
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// A socket in use and other files are left alone
+	if _, err := listen(unixPrefix+path, 0); err == nil {
+		t.Error("listening on a socket in use")
+	}
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listen(unixPrefix+file, 0); err == nil {
+		t.Error("listening over a regular file")
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Error(err)
+	}
+}
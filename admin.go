@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/ktcunreal/toriix/smux"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serveAdmin serves the local admin endpoint on addr, a tcp or unix:
+// address, in the background
+func serveAdmin(addr string, mode os.FileMode, tunnels *tunnelSet) error {
+	listener, err := listen(addr, mode)
+	if err != nil {
+		return err
+	}
+	slog.Info("Admin endpoint started", "addr", addr)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/reload", allow(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		slog.Info("Reloading config")
+		if err := tunnels.reload(); err != nil {
+			slog.Error("Reload failed", "err", err)
+			writeJSON(w, http.StatusBadRequest, adminError{err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, struct {
+			Tunnels []string `json:"tunnels"`
+		}{tunnels.names()})
+	}))
+
+	// Tunnels
+	mux.HandleFunc("/tunnels", allow(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		list := []tunnelInfo{}
+		for _, t := range tunnels.all() {
+			list = append(list, newTunnelInfo(t))
+		}
+		writeJSON(w, http.StatusOK, list)
+	}))
+	tunnelAction := func(action func(t *tunnel)) http.HandlerFunc {
+		return allow(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+			t := tunnels.get(r.FormValue("name"))
+			if t == nil {
+				writeJSON(w, http.StatusNotFound, adminError{"no running tunnel named " + strconv.Quote(r.FormValue("name"))})
+				return
+			}
+			action(t)
+			writeJSON(w, http.StatusOK, newTunnelInfo(t))
+		})
+	}
+	mux.HandleFunc("/tunnels/pause", tunnelAction(func(t *tunnel) {
+		t.paused.Store(true)
+		t.log.Info("Tunnel paused")
+	}))
+	mux.HandleFunc("/tunnels/resume", tunnelAction(func(t *tunnel) {
+		t.paused.Store(false)
+		t.log.Info("Tunnel resumed")
+	}))
+	mux.HandleFunc("/tunnels/reconnect", tunnelAction(func(t *tunnel) {
+		t.log.Info("Reconnecting sessions")
+		for _, session := range t.sessionList() {
+			t.goAway(session)
+		}
+	}))
+
+	// Sessions
+	mux.HandleFunc("/sessions", allow(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		name := r.FormValue("tunnel")
+		list := []sessionInfo{}
+		for _, t := range tunnels.all() {
+			if name != "" && t.name != name {
+				continue
+			}
+			for _, session := range t.sessionList() {
+				list = append(list, newSessionInfo(t, session))
+			}
+		}
+		writeJSON(w, http.StatusOK, list)
+	}))
+	sessionAction := func(action func(t *tunnel, session *smux.Session)) http.HandlerFunc {
+		return allow(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+			t, session := findSession(w, r, tunnels, "id")
+			if session == nil {
+				return
+			}
+			info := newSessionInfo(t, session)
+			action(t, session)
+			writeJSON(w, http.StatusOK, info)
+		})
+	}
+	mux.HandleFunc("/sessions/close", sessionAction(func(t *tunnel, session *smux.Session) {
+		session.Logger().Info("Closing session")
+		session.Close()
+	}))
+	mux.HandleFunc("/sessions/reconnect", sessionAction(func(t *tunnel, session *smux.Session) {
+		session.Logger().Info("Reconnecting session")
+		t.goAway(session)
+	}))
+
+	// Streams
+	mux.HandleFunc("/streams", allow(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		t, session := findSession(w, r, tunnels, "session")
+		if session == nil {
+			return
+		}
+		c := t.config()
+		list := []streamInfo{}
+		for _, stream := range session.Streams() {
+			list = append(list, newStreamInfo(c, stream))
+		}
+		writeJSON(w, http.StatusOK, list)
+	}))
+	mux.HandleFunc("/streams/close", allow(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		t, session := findSession(w, r, tunnels, "session")
+		if session == nil {
+			return
+		}
+		id, err := strconv.ParseUint(r.FormValue("id"), 10, 32)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, adminError{"invalid stream id " + strconv.Quote(r.FormValue("id"))})
+			return
+		}
+		for _, stream := range session.Streams() {
+			if stream.ID() == uint32(id) {
+				info := newStreamInfo(t.config(), stream)
+				stream.Logger().Info("Closing stream")
+				stream.Close()
+				writeJSON(w, http.StatusOK, info)
+				return
+			}
+		}
+		writeJSON(w, http.StatusNotFound, adminError{"no open stream " + strconv.Quote(r.FormValue("id"))})
+	}))
+
+	go func() {
+		if err := http.Serve(listener, localOnly(mux)); err != nil {
+			slog.Error("Admin endpoint stopped", "err", err)
+		}
+	}()
+	return nil
+}
+
+// findSession returns the session whose id is in param and its tunnel, or
+// writes the error and returns nil
+func findSession(w http.ResponseWriter, r *http.Request, tunnels *tunnelSet, param string) (*tunnel, *smux.Session) {
+	id, err := strconv.ParseUint(r.FormValue(param), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, adminError{"invalid session id " + strconv.Quote(r.FormValue(param))})
+		return nil, nil
+	}
+	t, session := tunnels.session(id)
+	if session == nil {
+		writeJSON(w, http.StatusNotFound, adminError{"no open session " + strconv.Quote(r.FormValue(param))})
+	}
+	return t, session
+}
+
+type tunnelInfo struct {
+	Name     string `json:"name"`
+	Mode     string `json:"mode"`
+	Ingress  string `json:"ingress"`
+	Egress   string `json:"egress"`
+	Reverse  string `json:"reverse,omitempty"`
+	Paused   bool   `json:"paused"`
+	Stopped  bool   `json:"stopped"` // removed or restarted, its sessions drain
+	Sessions int    `json:"sessions"`
+}
+
+func newTunnelInfo(t *tunnel) tunnelInfo {
+	c := t.config()
+	return tunnelInfo{
+		Name:     t.name,
+		Mode:     c.Mode,
+		Ingress:  c.Ingress,
+		Egress:   c.Egress,
+		Reverse:  c.Reverse,
+		Paused:   t.paused.Load(),
+		Stopped:  t.stopped(),
+		Sessions: t.numSessions(),
+	}
+}
+
+// sessionInfo describes a session, durations are in seconds. Peers only
+// prove they hold the key, the remote address is all there is to tell
+// them apart.
+type sessionInfo struct {
+	Tunnel   string  `json:"tunnel"`
+	ID       uint64  `json:"id"`
+	Remote   string  `json:"remote"`
+	Age      float64 `json:"age"`
+	Idle     float64 `json:"idle"`
+	Streams  int     `json:"streams"`
+	BytesIn  uint64  `json:"bytes_in"`
+	BytesOut uint64  `json:"bytes_out"`
+	RTT      float64 `json:"rtt"`
+}
+
+func newSessionInfo(t *tunnel, session *smux.Session) sessionInfo {
+	stats := session.Stats()
+	info := sessionInfo{
+		Tunnel:   t.name,
+		ID:       session.ID(),
+		Age:      seconds(time.Since(stats.Created)),
+		Idle:     seconds(time.Since(stats.LastActivity)),
+		Streams:  stats.Streams,
+		BytesIn:  stats.BytesIn,
+		BytesOut: stats.BytesOut,
+		RTT:      seconds(stats.RTT),
+	}
+	if addr := session.RemoteAddr(); addr != nil {
+		info.Remote = addr.String()
+	}
+	return info
+}
+
+// streamInfo describes a stream, durations are in seconds. The destination
+// is known for the streams opened by the peer, which are dialed here, and
+// for proxy requests.
+type streamInfo struct {
+	ID       uint32  `json:"id"`
+	Src      string  `json:"src,omitempty"`
+	Dst      string  `json:"dst,omitempty"`
+	Peer     bool    `json:"peer"` // opened by the peer
+	Age      float64 `json:"age"`
+	Idle     float64 `json:"idle"`
+	BytesIn  uint64  `json:"bytes_in"`
+	BytesOut uint64  `json:"bytes_out"`
+}
+
+func newStreamInfo(c *Config, stream *smux.Stream) streamInfo {
+	stats := stream.Stats()
+	hdr := streamHeader(stream.Metadata())
+	// Clients open odd streams, servers even ones
+	peer := (stream.ID()%2 == 1) == (c.Mode == "server")
+	info := streamInfo{
+		ID:       stream.ID(),
+		Src:      hdr[hdrSrc],
+		Peer:     peer,
+		Age:      seconds(time.Since(stats.Created)),
+		Idle:     seconds(time.Since(stats.LastActivity)),
+		BytesIn:  stats.BytesIn,
+		BytesOut: stats.BytesOut,
+	}
+	switch {
+	case hdr[hdrHello] != "":
+	case hdr[hdrDst] != "":
+		info.Dst = hdr[hdrDst]
+	case hdr[hdrBind] != "":
+		info.Dst = hdr[hdrBind]
+	case !peer:
+	case hdr[hdrBindConn] != "":
+		info.Dst, _ = c.bindLocal(hdr[hdrBindConn])
+	case c.Mode == "server":
+		info.Dst = c.Egress
+	default:
+		info.Dst = c.Reverse
+	}
+	return info
+}
+
+func seconds(d time.Duration) float64 {
+	return d.Round(time.Millisecond).Seconds()
+}
+
+// adminHeader must be set on the requests changing state, a browser can't
+// send it cross-site without a preflight the endpoint never answers
+const adminHeader = "X-Toriix-Admin"
+
+// allow refuses the requests using another method than method, and the
+// POST requests without adminHeader
+func allow(method string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			writeJSON(w, http.StatusMethodNotAllowed, adminError{"use " + method})
+			return
+		}
+		if method == http.MethodPost && r.Header.Get(adminHeader) == "" {
+			writeJSON(w, http.StatusForbidden, adminError{"missing " + adminHeader + " header"})
+			return
+		}
+		h(w, r)
+	}
+}
+
+// localOnly refuses the requests whose Host is not a loopback address, so
+// pages rebinding their own name to it can't reach the endpoint
+func localOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = strings.Trim(r.Host, "[]")
+		}
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			writeJSON(w, http.StatusForbidden, adminError{"host " + strconv.Quote(r.Host) + " is not a loopback address"})
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"github.com/ktcunreal/toriix/smux"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Bind asks the server to listen on Remote, connections accepted there
+// are forwarded to Local by the client
+type Bind struct {
+	Remote string `json:"remote"`
+	Local  string `json:"local"`
+}
+
+// bindLocal returns the local address of the bind registered for remote
+func (c *Config) bindLocal(remote string) (string, bool) {
+	for _, b := range c.Binds {
+		if b.Remote == remote {
+			return b.Local, true
+		}
+	}
+	return "", false
+}
+
+// bindAllowed reports whether addr matches an entry of allowlist, entries are
+// host:port where host may be * and port may be * or a range lo-hi
+func bindAllowed(addr string, allowlist []string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return false
+	}
+
+	for _, entry := range allowlist {
+		h, ports, err := net.SplitHostPort(entry)
+		if err != nil {
+			continue
+		}
+		if h != "*" && h != host {
+			continue
+		}
+		if ports == "*" {
+			return true
+		}
+		lo, hi, ok := strings.Cut(ports, "-")
+		if !ok {
+			hi = lo
+		}
+		l, err1 := strconv.Atoi(lo)
+		u, err2 := strconv.Atoi(hi)
+		if err1 == nil && err2 == nil && p >= l && p <= u {
+			return true
+		}
+	}
+	return false
+}
+
+// requestBind registers b on the server and holds the control stream
+// until the session ends or stop is closed
+func requestBind(session *smux.Session, b Bind, stop <-chan struct{}) error {
+	stream, err := openStream(session, streamHeader{hdrBind: b.Remote})
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	status, err := readStatus(stream)
+	if err != nil {
+		return err
+	}
+	if status != statusOK {
+		return fmt.Errorf("server refused to bind %s, status: %d", b.Remote, status)
+	}
+	session.Logger().Info("Remote bound", "remote", b.Remote, "local", b.Local)
+
+	holdStream(stream, stop)
+	return nil
+}
+
+// holdStream reads stream until the peer closes it, or closes it once stop
+// is closed
+func holdStream(stream *smux.Stream, stop <-chan struct{}) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+			stream.Close()
+		case <-done:
+		}
+	}()
+	io.Copy(io.Discard, stream)
+}
+
+// serveBind listens on addr for a client control stream, the listener is
+// released once the control stream or its session closes, or stop is closed
+func serveBind(session *smux.Session, ctrl *smux.Stream, addr string, c *Config, stop <-chan struct{}) {
+	if !bindAllowed(addr, c.AllowBinds) {
+		ctrl.Logger().Warn("Bind request refused", "addr", addr)
+		writeStatus(ctrl, statusRefused)
+		return
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		ctrl.Logger().Warn("Failed to bind", "addr", addr, "err", err)
+		writeStatus(ctrl, statusBindFailed)
+		return
+	}
+	defer listener.Close()
+	if c.AcceptProxyProtocol {
+		listener = &proxyProtoListener{listener}
+	}
+	if err := writeStatus(ctrl, statusOK); err != nil {
+		return
+	}
+	ctrl.Logger().Info("Bound", "addr", addr)
+
+	go func() {
+		for {
+			src, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(src net.Conn) {
+				defer src.Close()
+				stream, err := openStream(session, sourceHeader(streamHeader{hdrBindConn: addr}, src))
+				if err != nil {
+					session.Logger().Warn("Failed to open stream", "bind", addr, "err", err)
+					return
+				}
+				defer stream.Close()
+				smux.Pipe(src, stream, 0)
+			}(src)
+		}
+	}()
+
+	holdStream(ctrl, stop)
+	ctrl.Logger().Info("Released", "addr", addr)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/ktcunreal/toriix/smux"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBindAllowed(t *testing.T) {
+	allowlist := []string{"127.0.0.1:8080", "*:9000-9010", "0.0.0.0:*"}
+	for addr, want := range map[string]bool{
+		"127.0.0.1:8080": true,
+		"127.0.0.1:8081": false,
+		"10.0.0.1:9000":  true,
+		"10.0.0.1:9010":  true,
+		"10.0.0.1:9011":  false,
+		"0.0.0.0:22":     true,
+		"localhost:8080": false,
+		"127.0.0.1":      false,
+		"127.0.0.1:http": false,
+	} {
+		if got := bindAllowed(addr, allowlist); got != want {
+			t.Errorf("bindAllowed(%q) = %v, want %v", addr, got, want)
+		}
+	}
+	if bindAllowed("127.0.0.1:8080", nil) {
+		t.Error("empty allowlist allows binds")
+	}
+}
+
+func TestCheckBindPattern(t *testing.T) {
+	for entry, valid := range map[string]bool{
+		"127.0.0.1:8080":      true,
+		"*:9000-9010":         true,
+		"0.0.0.0:*":           true,
+		"[::1]:22":            true,
+		"127.0.0.1":           false,
+		"127.0.0.1:70000":     false,
+		"127.0.0.1:9010-9000": false,
+		"127.0.0.1:http":      false,
+		"127.0.0.1:1-":        false,
+	} {
+		if err := checkBindPattern(entry); (err == nil) != valid {
+			t.Errorf("checkBindPattern(%q) = %v, want valid %v", entry, err, valid)
+		}
+	}
+}
+
+func TestBind(t *testing.T) {
+	allowed, refused := freeAddr(t), freeAddr(t)
+	c := &Config{AllowBinds: []string{allowed}}
+
+	stop := make(chan struct{})
+	client, server := sessionPair(t)
+	go acceptStreams(server, func(stream *smux.Stream, hdr streamHeader) {
+		serveBind(server, stream, hdr[hdrBind], c, stop)
+	})
+	go acceptStreams(client, func(stream *smux.Stream, hdr streamHeader) {
+		fmt.Fprintln(stream, hdr[hdrBindConn])
+	})
+
+	if err := requestBind(client, Bind{Remote: refused}, stop); err == nil {
+		t.Errorf("bind of %s not refused", refused)
+	}
+	go requestBind(client, Bind{Remote: allowed}, stop)
+
+	// Connections to the bound address are carried to the client
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", allowed)
+		if err != nil {
+			if time.Now().After(deadline) {
+				t.Fatal(err)
+			}
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil || line != allowed+"\n" {
+			t.Errorf("greeting = %q, %v", line, err)
+		}
+		break
+	}
+
+	// Binds are released once stopped
+	close(stop)
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", allowed)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("bind not released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -1,59 +1,319 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"github.com/ktcunreal/toriix/smux"
-	"log"
+	"log/slog"
+	"maps"
 	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Config struct {
-	Ingress string `json:"ingress"`
-	Mode    string `json:"mode"`
-	Egress  string `json:"egress"`
-	PSK     string `json:"key"`
+	Name       string      `json:"name"`
+	Ingress    string      `json:"ingress"`
+	Mode       string      `json:"mode"`
+	Egress     string      `json:"egress"`
+	PSK        string      `json:"key"`
+	KeyFile    string      `json:"key_file"`
+	Proxy      bool        `json:"proxy"`
+	Network    string      `json:"network"`
+	UDPTimeout int         `json:"udp_timeout"`
+	Reverse    string      `json:"reverse"`
+	Binds      []Bind      `json:"binds"`
+	AllowBinds []string    `json:"allow_binds"`
+	SocketMode string      `json:"socket_mode"`
+	Transport  string      `json:"transport"`
+	WSPath     string      `json:"ws_path"`
+	WSHost     string      `json:"ws_host"`
+	TLS        *TLSConfig  `json:"tls"`
+	KCP        *KCPConfig  `json:"kcp"`
+	Paths      int         `json:"paths"`
+	Resume     int         `json:"resume"`
+	Upstream   string      `json:"upstream"`
+	Dial       *DialConfig `json:"dial"`
+	Smux       *SmuxConfig `json:"smux"`
+	LogLevel   string      `json:"log_level"`
+
+	ProxyProtocol       string `json:"proxy_protocol"`
+	AcceptProxyProtocol bool   `json:"accept_proxy_protocol"`
+
+	// Process wide settings, only read from the top level
+	Admin        string            `json:"admin"`
+	Metrics      string            `json:"metrics"`
+	DrainTimeout int               `json:"drain_timeout"`
+	LogFormat    string            `json:"log_format"`
+	Tunnels      []json.RawMessage `json:"tunnels"`
+
 	keyring smux.Keyring
 }
 
-func readFromConfig() *Config {
-	c := flag.String("c", "", "Configuration path")
-	i := flag.String("i", "", "ingress listen address")
-	e := flag.String("e", "", "egress address")
-	p := flag.String("p", "", "pre shared key")
-	m := flag.String("m", "", "mode")
-	flag.Parse()
+const (
+	envPrefix           = "TORIIX_"
+	defaultDrainTimeout = 30 * time.Second
+)
+
+// topLevelKeys are process wide settings, not inherited by tunnels
+var topLevelKeys = []string{"admin", "metrics", "drain_timeout", "log_format", "tunnels"}
 
-	conf := &Config{}
+// readFromConfig layers the config file given with -c, TORIIX_* environment
+// variables and the flags set on the command line, later layers override
+func readFromConfig(args []string) (*Config, error) {
+	fs := flag.NewFlagSet("toriix", flag.ExitOnError)
+	c := fs.String("c", "", "Configuration path, json, yaml or toml")
+	i := fs.String("i", "", "ingress listen address")
+	e := fs.String("e", "", "egress address")
+	p := fs.String("p", "", "pre shared key")
+	k := fs.String("k", "", "file containing the pre shared key")
+	m := fs.String("m", "", "mode")
+	x := fs.Bool("x", false, "http proxy on client ingress, allow proxy requests on server")
+	n := fs.String("n", "tcp", "ingress network, tcp or udp")
+	r := fs.String("r", "", "reverse tunnel, public listen address on server, local service address on client")
+	t := fs.String("t", "tcp", "transport between client and server")
+	fs.Parse(args)
 
+	conf := &Config{}
 	if *c != "" {
-		file, err := os.Open(*c)
-		defer file.Close()
-		log.Printf("Loading config from %s", *c)
+		slog.Info("Loading config", "path", *c)
+		var err error
+		if conf, err = loadConfig(*c); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := conf.applyEnv(os.Environ()); err != nil {
+		return nil, err
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "i":
+			conf.Ingress = *i
+		case "e":
+			conf.Egress = *e
+		case "p":
+			conf.PSK, conf.KeyFile = *p, ""
+		case "k":
+			conf.KeyFile, conf.PSK = *k, ""
+		case "m":
+			conf.Mode = *m
+		case "x":
+			conf.Proxy = *x
+		case "n":
+			conf.Network = *n
+		case "r":
+			conf.Reverse = *r
+		case "t":
+			conf.Transport = *t
+		}
+	})
+
+	if err := conf.loadKeyFile(); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// applyEnv sets the top level keys of the config from TORIIX_<KEY> variables
+// in env, such as TORIIX_EGRESS or TORIIX_KEY_FILE
+func (c *Config) applyEnv(env []string) error {
+	fields := make(map[string]reflect.Value)
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		tag, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("json"), ",")
+		if tag != "" && tag != "-" {
+			fields[envPrefix+strings.ToUpper(tag)] = v.Field(i)
+		}
+	}
+
+	for _, kv := range env {
+		name, value, _ := strings.Cut(kv, "=")
+		field, ok := fields[name]
+		if !ok {
+			continue
+		}
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			field.SetBool(b)
+		case reflect.Int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			field.SetInt(int64(n))
+		default:
+			return fmt.Errorf("%s: only set in the config file", name)
+		}
+
+		// The key set by the latest layer wins
+		switch name {
+		case envPrefix + "KEY":
+			c.KeyFile = ""
+		case envPrefix + "KEY_FILE":
+			c.PSK = ""
+		}
+	}
+	return nil
+}
+
+// loadKeyFile reads the key from key_file, keeping it out of the config
+// and the process arguments
+func (c *Config) loadKeyFile() error {
+	if c.KeyFile == "" {
+		return nil
+	}
+	if c.PSK != "" {
+		return errors.New("key and key_file are both set")
+	}
+	b, err := os.ReadFile(c.KeyFile)
+	if err != nil {
+		return err
+	}
+	c.PSK = strings.TrimRight(string(b), "\r\n")
+	return nil
+}
+
+// loadConfig parses a json, yaml or toml config file, unknown keys are
+// rejected
+func loadConfig(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if b, err = configJSON(b, configFormat(path)); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+
+	conf := &Config{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(conf); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	return conf, nil
+}
+
+// tunnelConfigs returns the config of each tunnel, entries of tunnels inherit
+// the top level keys they do not set, without tunnels c is the only one
+func (c *Config) tunnelConfigs() ([]*Config, error) {
+	if len(c.Tunnels) == 0 {
+		return []*Config{c}, nil
+	}
+
+	b, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var base map[string]json.RawMessage
+	if err := json.Unmarshal(b, &base); err != nil {
+		return nil, err
+	}
+	delete(base, "name")
+	for _, key := range topLevelKeys {
+		delete(base, key)
+	}
+	if c.PSK != "" {
+		// Already read from key_file
+		delete(base, "key_file")
+	}
+
+	var tunnels []*Config
+	for i, raw := range c.Tunnels {
+		var entry map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &entry); err != nil {
+			return nil, fmt.Errorf("tunnels[%d]: %v", i, err)
+		}
+		for _, key := range topLevelKeys {
+			if _, ok := entry[key]; ok {
+				return nil, fmt.Errorf("tunnels[%d]: %s is only allowed at the top level", i, key)
+			}
+		}
+
+		merged := maps.Clone(base)
+		if _, ok := entry["key"]; ok {
+			delete(merged, "key_file")
+		}
+		if _, ok := entry["key_file"]; ok {
+			delete(merged, "key")
+		}
+		for key, value := range entry {
+			merged[key] = value
+		}
+		b, err := json.Marshal(merged)
 		if err != nil {
-			log.Fatalf("Loading config failed %v", err)
+			return nil, err
 		}
-		if err := json.NewDecoder(file).Decode(conf); err != nil {
-			log.Fatalf("Parsing config failed: %v", err)
+
+		conf := &Config{}
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(conf); err != nil {
+			return nil, fmt.Errorf("tunnels[%d]: %v", i, err)
+		}
+		if err := conf.loadKeyFile(); err != nil {
+			return nil, fmt.Errorf("tunnels[%d]: %v", i, err)
 		}
-		return conf
+		tunnels = append(tunnels, conf)
 	}
+	return tunnels, nil
+}
 
-	conf.Ingress = *i
-	conf.Egress = *e
-	conf.PSK = *p
-	conf.Mode = *m
+// checkConfig validates the config without starting, and returns the exit code
+func checkConfig(args []string) int {
+	conf, err := readFromConfig(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Loading config failed: %v\n", err)
+		return 1
+	}
+	if err := conf.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Config is not valid:\n%v\n", err)
+		return 1
+	}
+	fmt.Println("Config OK")
+	return 0
+}
 
-	if !ValidateConf(conf) {
-		log.Fatalln("Config is not valid!")
+// udpTimeout returns how long an idle udp flow is kept
+func (c *Config) udpTimeout() time.Duration {
+	if c.UDPTimeout > 0 {
+		return time.Duration(c.UDPTimeout) * time.Second
 	}
+	return defaultUDPTimeout
+}
 
-	return conf
+// socketMode returns the permissions of unix socket files created by listeners,
+// zero leaves them to the umask
+func (c *Config) socketMode() os.FileMode {
+	mode, err := strconv.ParseUint(c.SocketMode, 8, 32)
+	if err != nil {
+		return 0
+	}
+	return os.FileMode(mode)
 }
-func ValidateConf(c *Config) bool {
-	// Check Addr length
-	if len(c.Ingress)*len(c.Egress) == 0 {
-		return false
+
+// drainTimeout returns how long running streams may take to finish on
+// shutdown
+func (c *Config) drainTimeout() time.Duration {
+	if c.DrainTimeout > 0 {
+		return time.Duration(c.DrainTimeout) * time.Second
 	}
-	return true
+	return defaultDrainTimeout
+}
+
+// resumeGrace returns how long a session survives without a connection
+func (c *Config) resumeGrace() time.Duration {
+	return time.Duration(c.Resume) * time.Second
 }
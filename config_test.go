@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/ktcunreal/toriix/smux"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	valid := &Config{Mode: "server", Ingress: "0.0.0.0:8443", Egress: "unix:/run/app.sock", PSK: testKey}
+	if err := valid.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	reverse := &Config{Mode: "client", Egress: "server.example.com:8443", Reverse: "127.0.0.1:80", PSK: testKey}
+	if err := reverse.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := &Config{
+		Mode:          "srv",
+		Ingress:       "127.0.0.1",
+		Egress:        "127.0.0.1:70000",
+		PSK:           "aaaaaaaaaaaaaaaaaaaaaaaa",
+		Transport:     "quic",
+		ProxyProtocol: "v3",
+		TLS:           &TLSConfig{Cert: "cert.pem"},
+		Admin:         "0.0.0.0:9000",
+	}
+	err := invalid.Validate()
+	if err == nil {
+		t.Fatal("invalid config accepted")
+	}
+	for _, key := range []string{"mode", "key", "ingress", "egress", "transport", "proxy_protocol", "tls", "admin"} {
+		if !strings.Contains(err.Error(), key+":") {
+			t.Errorf("no %s error in:\n%v", key, err)
+		}
+	}
+	var joined interface{ Unwrap() []error }
+	if !errors.As(err, &joined) || len(joined.Unwrap()) != 8 {
+		t.Errorf("want 8 problems, got:\n%v", err)
+	}
+
+	// Endpoints without auth stay local with several tunnels too
+	multi := &Config{
+		PSK:     testKey,
+		Admin:   "0.0.0.0:9000",
+		Metrics: "10.0.0.1:9100",
+		Tunnels: []json.RawMessage{json.RawMessage(`{"name": "web", "mode": "server", "ingress": "0.0.0.0:8443", "egress": "127.0.0.1:80"}`)},
+	}
+	err = multi.Validate()
+	for _, key := range []string{"admin", "metrics"} {
+		if err == nil || !strings.Contains(err.Error(), key+":") {
+			t.Errorf("no %s error in:\n%v", key, err)
+		}
+	}
+}
+
+func TestLoadConfigUnknownField(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"mode": "server", "kcp": {"mtu": 1200, "sndwindow": 64}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := loadConfig(path)
+	if err == nil || !strings.Contains(err.Error(), "sndwindow") {
+		t.Fatalf("unknown field not rejected: %v", err)
+	}
+}
+
+func TestLayeredConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	file := `{"mode": "client", "ingress": "127.0.0.1:1111", "egress": "file:2222", "key": "key-from-the-config-file", "udp_timeout": 30}`
+	if err := os.WriteFile(path, []byte(file), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "key")
+	if err := os.WriteFile(keyFile, []byte("key-from-a-secret-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("TORIIX_EGRESS", "env:2222")
+	t.Setenv("TORIIX_PROXY", "true")
+	t.Setenv("TORIIX_UDP_TIMEOUT", "90")
+	t.Setenv("TORIIX_KEY_FILE", keyFile)
+
+	conf, err := readFromConfig([]string{"-c", path, "-e", "flag:2222"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Config{Mode: "client", Ingress: "127.0.0.1:1111", Egress: "flag:2222", PSK: "key-from-a-secret-file",
+		KeyFile: keyFile, Proxy: true, UDPTimeout: 90}
+	if conf.Mode != want.Mode || conf.Ingress != want.Ingress || conf.Egress != want.Egress || conf.PSK != want.PSK ||
+		conf.Proxy != want.Proxy || conf.UDPTimeout != want.UDPTimeout || conf.Network != want.Network || conf.Transport != want.Transport {
+		t.Fatalf("got %+v\nwant %+v", *conf, want)
+	}
+
+	// A key flag replaces the key file set by a lower layer
+	conf, err = readFromConfig([]string{"-c", path, "-p", "key-from-the-command-line"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.PSK != "key-from-the-command-line" {
+		t.Fatalf("key %q, want the flag", conf.PSK)
+	}
+
+	t.Setenv("TORIIX_PATHS", "three")
+	if _, err := readFromConfig([]string{"-c", path}); err == nil || !strings.Contains(err.Error(), "TORIIX_PATHS") {
+		t.Fatalf("invalid env variable: %v", err)
+	}
+}
+
+func TestTunnelConfigs(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key")
+	if err := os.WriteFile(keyFile, []byte("key-from-a-secret-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.json")
+	file := `{
+		"mode": "server", "key": "key-from-the-config-file", "tls": {"sni": "example.com"}, "admin": "127.0.0.1:9000",
+		"tunnels": [
+			{"name": "web", "ingress": "0.0.0.0:443", "egress": "127.0.0.1:80"},
+			{"name": "ssh", "ingress": "0.0.0.0:2222", "egress": "127.0.0.1:22", "key_file": "` + keyFile + `", "tls": null}
+		]
+	}`
+	if err := os.WriteFile(path, []byte(file), 0600); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tunnels, err := conf.tunnelConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tunnels) != 2 {
+		t.Fatalf("%d tunnels, want 2", len(tunnels))
+	}
+	web, ssh := tunnels[0], tunnels[1]
+	if web.Name != "web" || web.Mode != "server" || web.Egress != "127.0.0.1:80" || web.PSK != "key-from-the-config-file" ||
+		web.TLS == nil || web.TLS.ServerName != "example.com" || web.Admin != "" {
+		t.Errorf("web tunnel %+v", *web)
+	}
+	if ssh.Name != "ssh" || ssh.Mode != "server" || ssh.PSK != "key-from-a-secret-file" || ssh.TLS != nil {
+		t.Errorf("ssh tunnel %+v", *ssh)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	conf.Tunnels = append(conf.Tunnels, json.RawMessage(`{"name": "web", "ingress": "0.0.0.0:8443"}`), json.RawMessage(`{"ingress": "x"}`))
+	err = conf.Validate()
+	for _, want := range []string{`tunnels[2].name: duplicate name "web"`, "tunnels[3].name: missing", "tunnels[3].ingress:", "tunnels[3].egress: missing"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("no %q in:\n%v", want, err)
+		}
+	}
+
+	conf.Tunnels = []json.RawMessage{json.RawMessage(`{"name": "nested", "tunnels": []}`)}
+	if _, err := conf.tunnelConfigs(); err == nil {
+		t.Error("nested tunnels accepted")
+	}
+}
+
+func TestConfigFormats(t *testing.T) {
+	files := map[string]string{
+		"config.json": `{
+			"mode": "client", "key": "key-from-the-config-file", "udp_timeout": 30,
+			"kcp": {"mtu": 1200},
+			"tunnels": [{"name": "web", "ingress": "127.0.0.1:1111", "egress": "server.example.com:2222"}]
+		}`,
+		"config.yaml": `
+# comments are allowed
+mode: client
+key: key-from-the-config-file
+udp_timeout: 30
+kcp:
+  mtu: 1200
+tunnels:
+  - name: web
+    ingress: 127.0.0.1:1111
+    egress: server.example.com:2222
+`,
+		"config.toml": `
+# comments are allowed
+mode = "client"
+key = "key-from-the-config-file"
+udp_timeout = 30
+
+[kcp]
+mtu = 1200
+
+[[tunnels]]
+name = "web"
+ingress = "127.0.0.1:1111"
+egress = "server.example.com:2222"
+`,
+	}
+
+	dir := t.TempDir()
+	var want []*Config
+	for _, name := range []string{"config.json", "config.yaml", "config.toml"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(files[name]), 0600); err != nil {
+			t.Fatal(err)
+		}
+		conf, err := loadConfig(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tunnels, err := conf.tunnelConfigs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want == nil {
+			want = tunnels
+			continue
+		}
+		if !reflect.DeepEqual(tunnels, want) {
+			t.Errorf("%s: got %+v, want %+v", name, *tunnels[0], *want[0])
+		}
+	}
+
+	// Convert through every format and back
+	path := filepath.Join(dir, "config.json")
+	for _, format := range []string{"toml", "yaml", "json"} {
+		out := filepath.Join(dir, "converted."+format)
+		if err := convertConfig([]string{path, out}); err != nil {
+			t.Fatal(err)
+		}
+		path = out
+	}
+	conf, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnels, err := conf.tunnelConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tunnels, want) {
+		t.Errorf("converted: got %+v, want %+v", *tunnels[0], *want[0])
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "bad.yaml"), []byte("mode: client\nkcp:\n  sndwindow: 64\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(filepath.Join(dir, "bad.yaml")); err == nil || !strings.Contains(err.Error(), "sndwindow") {
+		t.Fatalf("unknown field not rejected: %v", err)
+	}
+}
+
+func TestSmuxConfig(t *testing.T) {
+	var conf Config
+	if err := json.Unmarshal([]byte(`{"smux": {"keepalive_interval": 5, "max_frame_size": 16384}}`), &conf); err != nil {
+		t.Fatal(err)
+	}
+	sc := conf.smuxConfig()
+	if sc.KeepAliveInterval != 5*time.Second || sc.MaxFrameSize != 16384 || sc.KeepAliveTimeout != smux.DefaultConfig().KeepAliveTimeout {
+		t.Fatalf("smux config %+v", sc)
+	}
+
+	conf.Smux.KeepAliveTimeout = 1
+	if err := smux.VerifyConfig(conf.smuxConfig()); err == nil {
+		t.Fatal("keepalive timeout below interval accepted")
+	}
+}
+
+func TestSessionHello(t *testing.T) {
+	for _, tt := range []struct {
+		client, server int // smux versions
+		ok             bool
+	}{{1, 1, true}, {2, 2, true}, {2, 1, false}} {
+		server := &Config{Smux: DefaultSmuxConfig()}
+		server.Smux.Version = tt.server
+		client := &Config{Smux: DefaultSmuxConfig()}
+		client.Smux.Version = tt.client
+
+		sconn, cconn := net.Pipe()
+		ss, err := smux.Server(sconn, server.smuxConfig(), testKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cs, err := smux.Client(cconn, client.smuxConfig(), testKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			stream, err := ss.AcceptStream()
+			if err == nil {
+				handleStream(ss, stream, "", server, nil)
+			}
+		}()
+
+		err = sayHello(cs, client.smuxConfig())
+		if (err == nil) != tt.ok {
+			t.Fatalf("client v%d, server v%d: hello error %v", tt.client, tt.server, err)
+		}
+		if cs.IsClosed() == tt.ok {
+			t.Fatalf("client v%d, server v%d: session closed %v", tt.client, tt.server, cs.IsClosed())
+		}
+		cs.Close()
+		ss.Close()
+	}
+}
+
+func TestLogLevels(t *testing.T) {
+	var buf syncBuffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	tun := &tunnel{name: "web", metrics: new(tunnelMetrics)}
+	tun.log = newLogger(&tun.level).With("tunnel", tun.name)
+	tun.setConfig(&Config{LogLevel: "warn"})
+	conf := tun.smuxConfig(&Config{})
+
+	sconn, cconn := net.Pipe()
+	ss, err := smux.Server(sconn, conf, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ss.Close()
+	cs, err := smux.Client(cconn, nil, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+	go cs.OpenStream()
+	stream, err := ss.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream.Logger().Info("quiet")
+	stream.Logger().Warn("loud")
+	tun.setConfig(&Config{LogLevel: "debug"})
+	stream.Logger().Debug("verbose")
+
+	var records []map[string]interface{}
+	dec := json.NewDecoder(strings.NewReader(buf.String()))
+	for dec.More() {
+		var r map[string]interface{}
+		if err := dec.Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	var msgs []string
+	for _, r := range records {
+		msgs = append(msgs, r["msg"].(string))
+		if r["tunnel"] != "web" || r["session"] != float64(ss.ID()) || r["stream"] != float64(stream.ID()) {
+			t.Errorf("record fields %v", r)
+		}
+	}
+	if !reflect.DeepEqual(msgs, []string{"loud", "verbose"}) {
+		t.Errorf("logged %q, want loud and verbose", msgs)
+	}
+
+	err = (&Config{LogLevel: "loud", LogFormat: "xml"}).Validate()
+	for _, want := range []string{"log_level: unknown level", "log_format: unknown format"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("no %q in:\n%v", want, err)
+		}
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent writes
+type syncBuffer struct {
+	buf  bytes.Buffer
+	lock sync.Mutex
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
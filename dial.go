@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/net/proxy"
+	"net"
+	"time"
+)
+
+var (
+	ErrBindToDeviceUnsupported = errors.New("binding to an interface is not supported on this platform")
+)
+
+// DialConfig controls how connections to egress, or to the destinations of
+// proxy requests, are dialed. A nil config dials with the defaults.
+type DialConfig struct {
+	// Local source address and interface of outbound connections
+	Bind      string `json:"bind"`
+	Interface string `json:"interface"`
+
+	// Timeout in seconds, 0 waits for the OS
+	Timeout int `json:"timeout"`
+
+	// TCP keepalive period in seconds, 0 uses the Go default, negative disables
+	KeepAlive int `json:"keepalive"`
+
+	// Happy eyeballs delay in milliseconds before falling back from IPv6 to
+	// IPv4, 0 uses the Go default of 300ms, negative disables the fallback
+	FallbackDelay int `json:"fallback_delay"`
+
+	// SOCKS5 or http CONNECT proxy tcp connections go through
+	Upstream string `json:"upstream"`
+}
+
+// validate reports invalid settings before the first connection needs them
+func (d *DialConfig) validate() error {
+	if d == nil {
+		return nil
+	}
+	if d.Bind != "" && net.ParseIP(d.Bind) == nil {
+		return fmt.Errorf("invalid dial bind address %q", d.Bind)
+	}
+	if d.Interface != "" {
+		if _, err := net.InterfaceByName(d.Interface); err != nil {
+			return fmt.Errorf("invalid dial interface %q: %v", d.Interface, err)
+		}
+		if bindToDevice == nil {
+			return ErrBindToDeviceUnsupported
+		}
+	}
+	_, err := newDialer(d.Upstream, proxy.Direct)
+	return err
+}
+
+// netDialer returns a dialer for network applying the settings
+func (d *DialConfig) netDialer(network string) *net.Dialer {
+	nd := &net.Dialer{}
+	if d == nil {
+		return nd
+	}
+	nd.Timeout = time.Duration(d.Timeout) * time.Second
+	nd.KeepAlive = time.Duration(d.KeepAlive) * time.Second
+	nd.FallbackDelay = time.Duration(d.FallbackDelay) * time.Millisecond
+
+	if ip := net.ParseIP(d.Bind); ip != nil {
+		switch network {
+		case "tcp":
+			nd.LocalAddr = &net.TCPAddr{IP: ip}
+		case "udp":
+			nd.LocalAddr = &net.UDPAddr{IP: ip}
+		}
+	}
+	if d.Interface != "" && bindToDevice != nil && network != "unix" {
+		nd.Control = bindToDevice(d.Interface)
+	}
+	return nd
+}
+
+// Dial connects to addr on network, tcp connections go through the
+// upstream proxy if one is set
+func (d *DialConfig) Dial(network, addr string) (net.Conn, error) {
+	nd := d.netDialer(network)
+	if d == nil || d.Upstream == "" || network != "tcp" {
+		return nd.Dial(network, addr)
+	}
+
+	dialer, err := newDialer(d.Upstream, nd)
+	if err != nil {
+		return nil, err
+	}
+	return dialer.Dial(network, addr)
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"syscall"
+)
+
+// bindToDevice returns a socket control function binding sockets to iface
+var bindToDevice = func(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = syscall.BindToDevice(int(fd), iface)
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
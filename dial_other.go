@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import (
+	"syscall"
+)
+
+// bindToDevice is not available outside linux
+var bindToDevice func(iface string) func(network, address string, c syscall.RawConn) error
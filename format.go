@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Config file formats, picked by file extension. YAML and TOML files are
+// translated to JSON and decoded like JSON files, with the same keys.
+const (
+	formatJSON = "json"
+	formatYAML = "yaml"
+	formatTOML = "toml"
+)
+
+// configFormat returns the format of the config file at path, JSON unless
+// the extension says otherwise
+func configFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return formatYAML
+	case ".toml":
+		return formatTOML
+	}
+	return formatJSON
+}
+
+// configJSON returns the config b, in format, as JSON
+func configJSON(b []byte, format string) ([]byte, error) {
+	if format == formatJSON {
+		return b, nil
+	}
+	tree, err := decodeTree(b, format)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(tree)
+}
+
+// decodeTree decodes b into maps, slices and values
+func decodeTree(b []byte, format string) (interface{}, error) {
+	switch format {
+	case formatYAML:
+		var tree interface{}
+		if err := yaml.Unmarshal(b, &tree); err != nil {
+			return nil, err
+		}
+		return tree, nil
+	case formatTOML:
+		var tree map[string]interface{}
+		if _, err := toml.Decode(string(b), &tree); err != nil {
+			return nil, err
+		}
+		return tree, nil
+	case formatJSON:
+		var tree interface{}
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.UseNumber()
+		if err := dec.Decode(&tree); err != nil {
+			return nil, err
+		}
+		return jsonNumbers(tree)
+	}
+	return nil, fmt.Errorf("unknown config format %q, available: json, yaml, toml", format)
+}
+
+// jsonNumbers replaces the json.Number values of tree with integers where
+// possible, floats otherwise, so ports or timeouts stay integers in TOML
+func jsonNumbers(tree interface{}) (interface{}, error) {
+	switch v := tree.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n, nil
+		}
+		return v.Float64()
+	case map[string]interface{}:
+		for key, value := range v {
+			converted, err := jsonNumbers(value)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = converted
+		}
+	case []interface{}:
+		for i, value := range v {
+			converted, err := jsonNumbers(value)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = converted
+		}
+	}
+	return tree, nil
+}
+
+// encodeTree encodes a tree returned by decodeTree in format
+func encodeTree(tree interface{}, format string) ([]byte, error) {
+	switch format {
+	case formatYAML:
+		var buf bytes.Buffer
+		enc := yaml.NewEncoder(&buf)
+		enc.SetIndent(2)
+		if err := enc.Encode(tree); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case formatTOML:
+		if _, ok := tree.(map[string]interface{}); !ok {
+			return nil, errors.New("toml config must be a table")
+		}
+		var buf bytes.Buffer
+		if err := toml.NewEncoder(&buf).Encode(tree); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case formatJSON:
+		b, err := json.MarshalIndent(tree, "", "    ")
+		if err != nil {
+			return nil, err
+		}
+		return append(b, '\n'), nil
+	}
+	return nil, fmt.Errorf("unknown config format %q, available: json, yaml, toml", format)
+}
+
+// configCommand runs the config subcommands, and returns the exit code
+func configCommand(args []string) int {
+	if len(args) == 0 || args[0] != "convert" {
+		fmt.Fprintln(os.Stderr, "Usage: toriix config convert [-to json|yaml|toml] <input> [output]")
+		return 2
+	}
+	if err := convertConfig(args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "Converting config failed: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// convertConfig translates a config file to another format, picked by -to
+// or the extension of the output file. Keys are checked like on start,
+// comments are not carried over.
+func convertConfig(args []string) error {
+	fs := flag.NewFlagSet("toriix config convert", flag.ExitOnError)
+	to := fs.String("to", "", "output format, json, yaml or toml")
+	fs.Parse(args)
+
+	var input, output string
+	switch fs.NArg() {
+	case 2:
+		output = fs.Arg(1)
+		fallthrough
+	case 1:
+		input = fs.Arg(0)
+	default:
+		return errors.New("usage: toriix config convert [-to json|yaml|toml] <input> [output]")
+	}
+	format := *to
+	if format == "" {
+		if output == "" {
+			return errors.New("output format missing, set -to or an output file")
+		}
+		format = configFormat(output)
+	}
+
+	if _, err := loadConfig(input); err != nil {
+		return err
+	}
+	b, err := os.ReadFile(input)
+	if err != nil {
+		return err
+	}
+	tree, err := decodeTree(b, configFormat(input))
+	if err != nil {
+		return err
+	}
+	if b, err = encodeTree(tree, format); err != nil {
+		return err
+	}
+
+	if output == "" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	return os.WriteFile(output, b, 0600)
+}
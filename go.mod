@@ -3,12 +3,23 @@ module github.com/ktcunreal/toriix
 go 1.21.3
 
 require (
+	github.com/BurntSushi/toml v1.3.2
 	github.com/djherbis/buffer v1.2.0
 	github.com/djherbis/nio/v3 v3.0.1
+	github.com/gorilla/websocket v1.5.3
+	github.com/mroth/jitter v0.1.1
+	github.com/xtaci/kcp-go/v5 v5.6.8
 	golang.org/x/crypto v0.20.0
+	golang.org/x/net v0.21.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
-	github.com/mroth/jitter v0.1.1 // indirect
+	github.com/klauspost/cpuid/v2 v2.2.6 // indirect
+	github.com/klauspost/reedsolomon v1.12.0 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/templexxx/cpu v0.1.0 // indirect
+	github.com/templexxx/xorsimd v0.4.2 // indirect
+	github.com/tjfoc/gmsm v1.4.1 // indirect
 	golang.org/x/sys v0.17.0 // indirect
 )
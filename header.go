@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io"
+)
+
+// Stream header, sent as smux metadata by the opener of a stream
+const (
+	hdrDst      = "dst"       // destination address, empty for configured egress
+	hdrNet      = "net"       // network of the destination, empty for tcp
+	hdrBind     = "bind"      // remote address the client asks the server to listen on
+	hdrBindConn = "bind_conn" // remote bind address a server opened stream was accepted on
+	hdrSrc      = "src"       // peer address of the connection carried by the stream
+	hdrHello    = "hello"     // smux settings of the client, see sayHello
+)
+
+// status replied to streams requesting a destination or a bind
+const (
+	statusOK byte = iota
+	statusRefused
+	statusUnreachable
+	statusBindFailed
+)
+
+type streamHeader map[string]string
+
+func readStatus(r io.Reader) (byte, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func writeStatus(w io.Writer, status byte) error {
+	_, err := w.Write([]byte{status})
+	return err
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/xtaci/kcp-go/v5"
+	"log/slog"
+	"net"
+)
+
+var (
+	ErrKCPUnixAddr = errors.New("kcp transport does not support unix sockets")
+)
+
+// KCPConfig tunes the reliable udp transport, omitted keys keep the defaults
+type KCPConfig struct {
+	// Forward error correction shards, 0 parity shards disables FEC
+	DataShards   int `json:"data_shards"`
+	ParityShards int `json:"parity_shards"`
+
+	// Congestion control, see ikcp_nodelay
+	NoDelay      int `json:"nodelay"`
+	Interval     int `json:"interval"`
+	Resend       int `json:"resend"`
+	NoCongestion int `json:"nc"`
+
+	SendWindow    int  `json:"sndwnd"`
+	ReceiveWindow int  `json:"rcvwnd"`
+	MTU           int  `json:"mtu"`
+	ACKNoDelay    bool `json:"acknodelay"`
+	SocketBuffer  int  `json:"sockbuf"`
+}
+
+// DefaultKCPConfig returns the settings of the kcptun fast profile
+func DefaultKCPConfig() *KCPConfig {
+	return &KCPConfig{
+		DataShards:    10,
+		ParityShards:  3,
+		NoDelay:       0,
+		Interval:      30,
+		Resend:        2,
+		NoCongestion:  1,
+		SendWindow:    128,
+		ReceiveWindow: 512,
+		MTU:           1350,
+		SocketBuffer:  4194304,
+	}
+}
+
+func (k *KCPConfig) UnmarshalJSON(b []byte) error {
+	type plain KCPConfig
+	*k = *DefaultKCPConfig()
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	return dec.Decode((*plain)(k))
+}
+
+// kcpTransport carries sessions over kcp, a reliable udp protocol with
+// forward error correction, avoiding head-of-line blocking of tcp on lossy links
+type kcpTransport struct {
+	conf *KCPConfig
+}
+
+func init() {
+	registerTransport("kcp", func(c *Config, log *slog.Logger) (Transport, error) {
+		if c.Upstream != "" {
+			return nil, ErrUpstreamUnsupported
+		}
+		conf := DefaultKCPConfig()
+		if c.KCP != nil {
+			*conf = *c.KCP
+		}
+		if conf.ParityShards == 0 {
+			conf.DataShards = 0
+		}
+		return &kcpTransport{conf: conf}, nil
+	})
+}
+
+func (t *kcpTransport) Dial(addr string) (net.Conn, error) {
+	if network, _ := splitAddr(addr); network == "unix" {
+		return nil, ErrKCPUnixAddr
+	}
+	sess, err := kcp.DialWithOptions(addr, nil, t.conf.DataShards, t.conf.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+	sess.SetReadBuffer(t.conf.SocketBuffer)
+	sess.SetWriteBuffer(t.conf.SocketBuffer)
+	t.tune(sess)
+	return sess, nil
+}
+
+func (t *kcpTransport) Listen(addr string) (net.Listener, error) {
+	if network, _ := splitAddr(addr); network == "unix" {
+		return nil, ErrKCPUnixAddr
+	}
+	ln, err := kcp.ListenWithOptions(addr, nil, t.conf.DataShards, t.conf.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+	ln.SetReadBuffer(t.conf.SocketBuffer)
+	ln.SetWriteBuffer(t.conf.SocketBuffer)
+	return &kcpListener{Listener: ln, t: t}, nil
+}
+
+func (t *kcpTransport) tune(sess *kcp.UDPSession) {
+	sess.SetStreamMode(true)
+	sess.SetWriteDelay(false)
+	sess.SetNoDelay(t.conf.NoDelay, t.conf.Interval, t.conf.Resend, t.conf.NoCongestion)
+	sess.SetWindowSize(t.conf.SendWindow, t.conf.ReceiveWindow)
+	sess.SetMtu(t.conf.MTU)
+	sess.SetACKNoDelay(t.conf.ACKNoDelay)
+}
+
+// kcpListener applies the transport settings to accepted sessions
+type kcpListener struct {
+	*kcp.Listener
+	t *kcpTransport
+}
+
+func (l *kcpListener) Accept() (net.Conn, error) {
+	sess, err := l.AcceptKCP()
+	if err != nil {
+		return nil, err
+	}
+	l.t.tune(sess)
+	return sess, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Log formats, set with log_format
+const (
+	logText = "text"
+	logJSON = "json"
+)
+
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// logLevel is the verbosity of the process wide logger, tunnels have their
+// own with log_level
+var logLevel slog.LevelVar
+
+// levelHandler filters the records of a handler by a level of its own, so
+// loggers sharing an output can have different verbosity
+type levelHandler struct {
+	slog.Handler
+	level slog.Leveler
+}
+
+func (h *levelHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{h.Handler.WithAttrs(attrs), h.level}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{h.Handler.WithGroup(name), h.level}
+}
+
+// setupLogging sends the logs to stderr in format, the log package included
+func setupLogging(format string) {
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	var h slog.Handler
+	if format == logJSON {
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		h = slog.NewTextHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(&levelHandler{h, &logLevel}))
+}
+
+// newLogger returns a logger writing to the output of the default logger,
+// with its own level
+func newLogger(level slog.Leveler) *slog.Logger {
+	h := slog.Default().Handler()
+	if l, ok := h.(*levelHandler); ok {
+		h = l.Handler
+	}
+	return slog.New(&levelHandler{h, level})
+}
+
+// fatal logs msg and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// parseLogLevel returns the level named by s, info when empty
+func parseLogLevel(s string) (slog.Level, error) {
+	if s == "" {
+		return slog.LevelInfo, nil
+	}
+	level, ok := logLevels[strings.ToLower(s)]
+	if !ok {
+		return 0, fmt.Errorf("unknown level %q, debug, info, warn or error", s)
+	}
+	return level, nil
+}
+
+// logLevel returns the verbosity set by log_level
+func (c *Config) logLevel() slog.Level {
+	level, _ := parseLogLevel(c.LogLevel)
+	return level
+}
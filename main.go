@@ -2,10 +2,11 @@ package main
 
 import (
 	"github.com/ktcunreal/toriix/smux"
-	"io"
-	"log"
+	"log/slog"
 	"net"
-	"time"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 var (
@@ -13,143 +14,173 @@ var (
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "check":
+			os.Exit(checkConfig(os.Args[2:]))
+		case "config":
+			os.Exit(configCommand(os.Args[2:]))
+		}
+	}
+
 	if len(Version) > 0 {
-		log.Printf("Toriix version: %s\n", Version)
+		slog.Info("Starting", "version", Version)
 	} else {
-		log.Printf("Running in dev mode")
+		slog.Info("Running in dev mode")
 	}
 
-	f := readFromConfig()
-	switch f.Mode {
-	case "server":
-		server(f)
-	case "client":
-		client(f)
-	default:
-		log.Fatalln("Please specify running mode!")
+	f, err := readFromConfig(os.Args[1:])
+	if err != nil {
+		fatal("Loading config failed", "err", err)
 	}
-}
+	if err := f.Validate(); err != nil {
+		fatal("Config is not valid", "err", err)
+	}
+	setupLogging(f.LogFormat)
 
-func server(c *Config) {
-	server := struct {
-		conf *Config
-	}{
-		conf: c,
+	tunnels := newTunnelSet(os.Args[1:])
+	if err := tunnels.apply(f); err != nil {
+		fatal("Starting tunnels failed", "err", err)
+	}
+	if f.Admin != "" {
+		if err := serveAdmin(f.Admin, f.socketMode(), tunnels); err != nil {
+			fatal("Starting admin endpoint failed", "err", err)
+		}
+	}
+	if f.Metrics != "" {
+		if err := serveMetrics(f.Metrics, f.socketMode(), tunnels); err != nil {
+			fatal("Starting metrics endpoint failed", "err", err)
+		}
 	}
-	
-	listener := initListener(server.conf.Ingress)
-	defer listener.Close()
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Printf("Failed to accept incoming tcp connection %v", err)
+	// Reload the config on SIGHUP, running sessions are kept. Drain them on
+	// SIGTERM or interrupt, a second one exits right away.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM, os.Interrupt)
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			slog.Info("Reloading config")
+			if err := tunnels.reload(); err != nil {
+				slog.Error("Reload failed", "err", err)
+			}
 			continue
 		}
-		defer conn.Close()
 
-		go func(conn net.Conn) {
-			defer conn.Close()
-			session, err := smux.Server(conn, nil, server.conf.PSK)
-			if err != nil {
-				log.Printf("Failed to create smux session: %v\n", err)
+		slog.Info("Draining sessions", "signal", sig.String())
+		done := make(chan struct{})
+		go func() {
+			tunnels.shutdown()
+			close(done)
+		}()
+		for {
+			select {
+			case <-done:
+				slog.Info("Drained, exiting")
 				return
-			}
-			defer session.Close()
-
-			for {
-				// Accept smux stream
-				src, err := session.AcceptStream()
-				if err != nil {
-					log.Printf("Failed to accept smux stream: %v\n", err)
-					if err == smux.ErrInvalidProtocol || err == smux.ErrDecryptFailed || err == smux.ErrInvalidHeader {
-						io.Copy(io.Discard, conn)
-					}
+			case sig := <-signals:
+				if sig != syscall.SIGHUP {
+					slog.Info("Exiting", "signal", sig.String())
 					return
 				}
-				defer src.Close()
-
-				// Establish Remote TCP connection
-				go func(src *smux.Stream) {
-					defer src.Close()
-					dst, err := net.Dial("tcp", server.conf.Egress)
-					if err != nil {
-						log.Printf("Upstream service unreachable: %v", err)
-						return
-					}
-					defer dst.Close()
-
-					// Forwarding
-					smux.Pipe(src, dst, 0)
-				}(src)
 			}
-		}(conn)
+		}
 	}
 }
 
-func client(c *Config) {
-	client := struct {
-		conf *Config
-	}{
-		conf: c,
+// handleStream dials egress, or the destination requested in the stream
+// header, and forwards the stream to it. Binds are released once stop is
+// closed.
+func handleStream(session *smux.Session, src *smux.Stream, egress string, c *Config, stop <-chan struct{}) {
+	defer src.Close()
+	hdr := streamHeader(src.Metadata())
+	log := src.Logger()
+	if hdr[hdrSrc] != "" {
+		log = log.With("src", hdr[hdrSrc])
 	}
 
-	listener := initListener(client.conf.Ingress)
-	defer listener.Close()
-	for {
-		conn, err := net.Dial("tcp", client.conf.Egress)
-		if err != nil {
-			log.Println("Tcp server unreachable")
-			time.Sleep(time.Second * 5)
-			continue
+	if hdr[hdrHello] != "" {
+		if err := serveHello(session, src, hdr[hdrHello], c.smuxConfig()); err != nil {
+			log.Warn("Session hello failed", "err", err)
 		}
-		defer conn.Close()
+		return
+	}
+
+	if hdr[hdrBind] != "" {
+		serveBind(session, src, hdr[hdrBind], c, stop)
+		return
+	}
+
+	if hdr[hdrBindConn] != "" {
+		local, ok := c.bindLocal(hdr[hdrBindConn])
+		if !ok {
+			log.Warn("Unknown bind", "bind", hdr[hdrBindConn])
+			return
+		}
+		egress = local
+	}
 
-		session, err := smux.Client(conn, nil, client.conf.PSK)
+	if hdr[hdrNet] == "udp" {
+		dst, err := c.Dial.Dial("udp", egress)
 		if err != nil {
-			log.Printf("Failed to create smux session: %v\n", err)
-			continue
+			metricsFor(tunnelName(c)).DialFailures.Add(1)
+			log.Warn("Upstream service unreachable", "dst", egress, "err", err)
+			return
 		}
-		defer session.Close()
+		defer dst.Close()
+		relayUDP(src, dst, c.udpTimeout())
+		return
+	}
 
-		for {
-			if session.IsClosed() {
-				log.Println("Session is closed")
-				break
-			}
-			src, err := listener.Accept()
-			if err != nil {
-				log.Printf("Failed to accept incoming tcp connection: %v\n", err)
-				continue
-			}
-			defer src.Close()
-
-			go func(src net.Conn, session *smux.Session) {
-				defer src.Close()
-				stream, err := session.OpenStream()
-				if err != nil {
-					log.Printf("Smux stream down: %v\n", err)
-					session.Close()
-					return
-				}
-				defer stream.Close()
-				err1, err2 := smux.Pipe(src, stream, 0)
-				if err1 != nil && err1 != io.EOF {
-					log.Printf("%v\n", err1)
-				}
-				if err2 != nil && err2 != io.EOF {
-					log.Printf("%v\n", err2)
-				}
-			}(src, session)
+	network, addr := splitAddr(egress)
+	if hdr[hdrDst] != "" {
+		if !c.Proxy {
+			log.Warn("Proxy request refused", "dst", hdr[hdrDst])
+			writeStatus(src, statusRefused)
+			return
+		}
+		network, addr = "tcp", hdr[hdrDst]
+	}
+
+	dst, err := c.Dial.Dial(network, addr)
+	if err != nil {
+		metricsFor(tunnelName(c)).DialFailures.Add(1)
+		log.Warn("Upstream service unreachable", "dst", addr, "err", err)
+		if hdr[hdrDst] != "" {
+			writeStatus(src, statusUnreachable)
+		}
+		return
+	}
+	defer dst.Close()
+
+	if hdr[hdrDst] != "" {
+		if err := writeStatus(src, statusOK); err != nil {
+			return
 		}
 	}
+
+	// Pass the original client address on to the configured egress
+	if c.ProxyProtocol != "" && hdr[hdrDst] == "" {
+		if err := writeProxyHeader(dst, c.ProxyProtocol, hdr[hdrSrc], dst.RemoteAddr()); err != nil {
+			log.Warn("Failed to write proxy protocol header", "err", err)
+			return
+		}
+	}
+
+	// Forwarding
+	log.Debug("Forwarding", "dst", addr)
+	smux.Pipe(src, dst, 0)
+}
+
+// openStream opens a new stream carrying hdr
+func openStream(session *smux.Session, hdr streamHeader) (*smux.Stream, error) {
+	return session.OpenStreamWithMetadata(hdr)
 }
 
-func initListener(addr string) net.Listener {
-	defer log.Printf("LISTENER STARTED ON %s", addr)
-	listener, err := net.Listen("tcp", addr)
+func initListener(addr string, mode os.FileMode) (net.Listener, error) {
+	listener, err := listen(addr, mode)
 	if err != nil {
-		log.Fatalln("LISTENER FAILED TO START: ", err)
+		return nil, err
 	}
-	return listener
+	slog.Info("Listener started", "addr", addr)
+	return listener, nil
 }
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/ktcunreal/toriix/smux"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// tunnelMetrics counts the traffic of a tunnel. They are kept by name for
+// the life of the process, so counters carry on across reloads and restarts.
+type tunnelMetrics struct {
+	smux.Counters
+	DialFailures atomic.Uint64 // dialing egress or proxy destinations
+}
+
+var metrics = struct {
+	tunnels map[string]*tunnelMetrics
+	lock    sync.Mutex
+}{tunnels: make(map[string]*tunnelMetrics)}
+
+// metricsFor returns the metrics of the tunnel named name
+func metricsFor(name string) *tunnelMetrics {
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	m, ok := metrics.tunnels[name]
+	if !ok {
+		m = new(tunnelMetrics)
+		metrics.tunnels[name] = m
+	}
+	return m
+}
+
+// serveMetrics serves the metrics in the Prometheus text format on addr,
+// a tcp or unix: address, in the background
+func serveMetrics(addr string, mode os.FileMode, tunnels *tunnelSet) error {
+	listener, err := listen(addr, mode)
+	if err != nil {
+		return err
+	}
+	slog.Info("Metrics endpoint started", "addr", addr)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w, tunnels)
+	})
+
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			slog.Error("Metrics endpoint stopped", "err", err)
+		}
+	}()
+	return nil
+}
+
+// sessionGauges are the current state of the sessions of a tunnel
+type sessionGauges struct {
+	sessions, streams, shaperQueue, tokenBucket int
+}
+
+// gauges sums up the sessions of the running and draining tunnels by name
+func (s *tunnelSet) gauges() map[string]*sessionGauges {
+	gauges := make(map[string]*sessionGauges)
+	for _, t := range s.all() {
+		g, ok := gauges[t.name]
+		if !ok {
+			g = &sessionGauges{}
+			gauges[t.name] = g
+		}
+		for _, session := range t.sessionList() {
+			stats := session.Stats()
+			g.sessions++
+			g.streams += stats.Streams
+			g.shaperQueue += stats.ShaperQueue
+			g.tokenBucket += stats.TokenBucket
+		}
+	}
+	return gauges
+}
+
+// writeMetrics writes the metrics of every tunnel seen since start
+func writeMetrics(w io.Writer, tunnels *tunnelSet) error {
+	gauges := tunnels.gauges()
+
+	metrics.lock.Lock()
+	counters := make(map[string]*tunnelMetrics, len(metrics.tunnels))
+	for name, m := range metrics.tunnels {
+		counters[name] = m
+	}
+	metrics.lock.Unlock()
+
+	var names []string
+	for name := range counters {
+		names = append(names, name)
+	}
+	for name := range gauges {
+		if _, ok := counters[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	bw := bufio.NewWriter(w)
+	family := func(name, kind, help string, value func(tunnel string) []sample) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, tunnel := range names {
+			for _, s := range value(tunnel) {
+				labels := `tunnel="` + escapeLabel(tunnel) + `"`
+				if s.label != "" {
+					labels += "," + s.label
+				}
+				fmt.Fprintf(bw, "%s{%s} %d\n", name, labels, s.value)
+			}
+		}
+	}
+	gauge := func(get func(*sessionGauges) int) func(string) []sample {
+		return func(tunnel string) []sample {
+			g, ok := gauges[tunnel]
+			if !ok {
+				g = &sessionGauges{}
+			}
+			return []sample{{"", uint64(max(get(g), 0))}}
+		}
+	}
+	counter := func(get func(*tunnelMetrics) []sample) func(string) []sample {
+		return func(tunnel string) []sample {
+			m, ok := counters[tunnel]
+			if !ok {
+				m = new(tunnelMetrics)
+			}
+			return get(m)
+		}
+	}
+
+	family("toriix_sessions", "gauge", "Open sessions.",
+		gauge(func(g *sessionGauges) int { return g.sessions }))
+	family("toriix_streams", "gauge", "Open streams.",
+		gauge(func(g *sessionGauges) int { return g.streams }))
+	family("toriix_shaper_queue_frames", "gauge", "Frames waiting to be sent.",
+		gauge(func(g *sessionGauges) int { return g.shaperQueue }))
+	family("toriix_token_bucket_bytes", "gauge", "Bytes the sessions may still buffer before they stop reading.",
+		gauge(func(g *sessionGauges) int { return g.tokenBucket }))
+	family("toriix_bytes_total", "counter", "Bytes carried by the session connections.",
+		counter(func(m *tunnelMetrics) []sample {
+			return []sample{{`direction="in"`, m.BytesIn.Load()}, {`direction="out"`, m.BytesOut.Load()}}
+		}))
+	family("toriix_frames_total", "counter", "Smux frames carried by the session connections.",
+		counter(func(m *tunnelMetrics) []sample {
+			return []sample{{`direction="in"`, m.FramesIn.Load()}, {`direction="out"`, m.FramesOut.Load()}}
+		}))
+	family("toriix_decrypt_failures_total", "counter", "Frames failing authentication, sessions are closed on the first one.",
+		counter(func(m *tunnelMetrics) []sample {
+			return []sample{{`part="header"`, m.HeaderFailures.Load()}, {`part="data"`, m.DecryptFailures.Load()}}
+		}))
+	family("toriix_keepalive_timeouts_total", "counter", "Sessions closed for lack of keepalive.",
+		counter(func(m *tunnelMetrics) []sample { return []sample{{"", m.KeepAliveTimeouts.Load()}} }))
+	family("toriix_dial_failures_total", "counter", "Failed dials to egress or proxy destinations.",
+		counter(func(m *tunnelMetrics) []sample { return []sample{{"", m.DialFailures.Load()}} }))
+	return bw.Flush()
+}
+
+type sample struct {
+	label string
+	value uint64
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
@@ -0,0 +1,868 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"github.com/ktcunreal/toriix/smux"
+	"golang.org/x/crypto/nacl/secretbox"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Multipath stripes one session over several connections of the inner
+// transport. Chunks carry sequence numbers for reordering and are kept until
+// the peer acknowledges having read them, so chunks sent on a lost path are
+// retransmitted on the others. With a grace period, a connection that lost
+// all its paths waits for the client to reattach one, which resumes the
+// session when the only connection breaks.
+//
+// Each path is keyed by the PSK and a random nonce from both ends, everything
+// after the nonces is sealed with secretbox under counter nonces, so a path
+// is authenticated by its first request and nothing is read off the wire in
+// the clear. A path failing to open a box is dropped.
+//
+// Handshake on each path, the request is sealed under the client nonce only:
+//
+//	client: |24B nonce|sealed 1B flag|16B group id|8B consumed seq|
+//	server: |24B nonce|sealed 1B status|8B consumed seq|
+//
+// Frames, a sealed header of fixed size followed by the sealed payload of
+// data frames:
+//
+//	data: |sealed 1B mpData|8B seq|2B length|sealed payload|
+//	ack:  |sealed 1B mpAck|8B consumed seq|2B 0|
+//	fin:  |sealed 1B mpFin|8B 0|2B 0|
+const (
+	mpData byte = iota
+	mpAck
+	mpFin
+)
+
+const (
+	mpNewGroup byte = iota
+	mpJoinGroup
+)
+
+const (
+	mpStatusOK byte = iota
+	mpStatusUnknownGroup
+)
+
+const (
+	mpChunkSize        = 16384
+	mpWindow           = 8 << 20 // max unacknowledged bytes
+	mpWindowChunks     = mpWindow / mpChunkSize
+	mpNonceSize        = 24
+	mpHeaderSize       = 11
+	mpAckInterval      = time.Second
+	mpPathTimeout      = 15 * time.Second
+	mpHandshakeTimeout = 10 * time.Second
+	mpRedialInterval   = 5 * time.Second
+)
+
+var (
+	ErrUnknownGroup = errors.New("multipath group unknown to server")
+	ErrNoPath       = errors.New("all paths of multipath connection lost")
+	ErrInvalidFrame = errors.New("invalid multipath frame")
+	ErrPathTimeout  = errors.New("multipath path timeout")
+	ErrPathAuth     = errors.New("multipath path failed authentication")
+	ErrPathReplayed = errors.New("multipath path replayed")
+)
+
+type mpGroupID [16]byte
+
+// mpTransport wraps an inner transport into multipath connections
+type mpTransport struct {
+	inner Transport
+	paths int
+	grace time.Duration // how long a connection without paths waits to resume
+	psk   func() string // keys new paths, follows reloads
+	log   *slog.Logger
+}
+
+func (t *mpTransport) Dial(addr string) (net.Conn, error) {
+	var id mpGroupID
+	rand.Read(id[:])
+
+	dial := func(flag byte, consumed uint64) (*mpPath, uint64, error) {
+		conn, err := t.inner.Dial(addr)
+		if err != nil {
+			return nil, 0, err
+		}
+		p, peerConsumed, err := mpClientHandshake(conn, t.psk(), flag, id, consumed)
+		if err != nil {
+			conn.Close()
+			return nil, 0, err
+		}
+		return p, peerConsumed, nil
+	}
+
+	p, _, err := dial(mpNewGroup, 0)
+	if err != nil {
+		return nil, err
+	}
+	c := newMPConn(id, p, t.grace, t.log)
+	c.redial = func() (*mpPath, uint64, error) {
+		return dial(mpJoinGroup, c.consumed())
+	}
+	for i := 1; i < t.paths; i++ {
+		go c.addPath()
+	}
+	return c, nil
+}
+
+func (t *mpTransport) Listen(addr string) (net.Listener, error) {
+	ln, err := t.inner.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	l := &mpListener{
+		Listener: ln,
+		groups:   make(map[mpGroupID]*mpConn),
+		accepts:  make(chan net.Conn),
+		grace:    t.grace,
+		psk:      t.psk,
+		log:      t.log,
+		die:      make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l, nil
+}
+
+func mpClientHandshake(conn net.Conn, psk string, flag byte, id mpGroupID, consumed uint64) (*mpPath, uint64, error) {
+	conn.SetDeadline(time.Now().Add(mpHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	nonce := make([]byte, 2*mpNonceSize)
+	rand.Read(nonce[:mpNonceSize])
+	hello, _ := mpBoxes(psk, nonce[:mpNonceSize])
+	var req [25]byte
+	req[0] = flag
+	copy(req[1:17], id[:])
+	binary.LittleEndian.PutUint64(req[17:], consumed)
+	if _, err := conn.Write(hello.seal(nonce[:mpNonceSize:mpNonceSize], req[:])); err != nil {
+		return nil, 0, err
+	}
+
+	if _, err := io.ReadFull(conn, nonce[mpNonceSize:]); err != nil {
+		return nil, 0, err
+	}
+	send, recv := mpBoxes(psk, nonce)
+	resp, err := recv.readFrom(conn, 9)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp[0] != mpStatusOK {
+		return nil, 0, ErrUnknownGroup
+	}
+	return newMPPath(conn, send, recv), binary.LittleEndian.Uint64(resp[1:]), nil
+}
+
+// mpBox seals and opens the frames of a path in one direction
+type mpBox struct {
+	key   [32]byte
+	nonce [24]byte // counter, the key is unique to the path and direction
+}
+
+// mpBoxes derives the boxes of the client and server directions from the
+// psk and the nonces of a path
+func mpBoxes(psk string, nonce []byte) (client, server *mpBox) {
+	k := smux.NewKeyring(psk)
+	client, server = new(mpBox), new(mpBox)
+	copy(client.key[:], k.Extract(nonce, "multipath client"))
+	copy(server.key[:], k.Extract(nonce, "multipath server"))
+	return client, server
+}
+
+func (b *mpBox) next() {
+	binary.LittleEndian.PutUint64(b.nonce[:8], binary.LittleEndian.Uint64(b.nonce[:8])+1)
+}
+
+// seal appends the sealed plain to out
+func (b *mpBox) seal(out, plain []byte) []byte {
+	out = secretbox.Seal(out, plain, &b.nonce, &b.key)
+	b.next()
+	return out
+}
+
+// readFrom reads and opens a box of n plain bytes
+func (b *mpBox) readFrom(r io.Reader, n int) ([]byte, error) {
+	buf := make([]byte, n+secretbox.Overhead)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	plain, ok := secretbox.Open(nil, buf, &b.nonce, &b.key)
+	if !ok {
+		return nil, ErrPathAuth
+	}
+	b.next()
+	return plain, nil
+}
+
+// mpListener groups the accepted paths by group id, a connection is
+// returned by Accept when the first path of its group arrives
+type mpListener struct {
+	net.Listener
+	groups    map[mpGroupID]*mpConn
+	groupLock sync.Mutex
+	accepts   chan net.Conn
+	grace     time.Duration
+	psk       func() string
+	log       *slog.Logger
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+func (l *mpListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.Close()
+			return
+		}
+		go func() {
+			if err := l.handshake(conn); err != nil {
+				l.log.Warn("Multipath handshake failed", "remote", conn.RemoteAddr().String(), "err", err)
+				conn.Close()
+			}
+		}()
+	}
+}
+
+// handshake authenticates conn and adds it to its group, nothing is sent
+// back to a peer without the psk
+func (l *mpListener) handshake(conn net.Conn) error {
+	psk := l.psk()
+	nonce := make([]byte, 2*mpNonceSize)
+	conn.SetReadDeadline(time.Now().Add(mpHandshakeTimeout))
+	if _, err := io.ReadFull(conn, nonce[:mpNonceSize]); err != nil {
+		return err
+	}
+	hello, _ := mpBoxes(psk, nonce[:mpNonceSize])
+	req, err := hello.readFrom(conn, 25)
+	if err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Time{})
+	var id mpGroupID
+	copy(id[:], req[1:17])
+	peerConsumed := binary.LittleEndian.Uint64(req[17:])
+
+	rand.Read(nonce[mpNonceSize:])
+	recv, send := mpBoxes(psk, nonce)
+	respond := func(status byte, consumed uint64) error {
+		var resp [9]byte
+		resp[0] = status
+		binary.LittleEndian.PutUint64(resp[1:], consumed)
+		_, err := conn.Write(send.seal(nonce[mpNonceSize:], resp[:]))
+		return err
+	}
+	p := newMPPath(conn, send, recv)
+
+	l.groupLock.Lock()
+	c, ok := l.groups[id]
+	if req[0] == mpJoinGroup && !ok {
+		l.groupLock.Unlock()
+		respond(mpStatusUnknownGroup, 0)
+		return ErrUnknownGroup
+	}
+	if !ok {
+		// a new group is accepted once its first path completes the handshake
+		if err := respond(mpStatusOK, 0); err != nil {
+			l.groupLock.Unlock()
+			return err
+		}
+		c = newMPConn(id, p, l.grace, l.log)
+		c.joined(nonce[:mpNonceSize])
+		l.groups[id] = c
+		l.groupLock.Unlock()
+
+		go func() {
+			<-c.die
+			l.groupLock.Lock()
+			delete(l.groups, id)
+			l.groupLock.Unlock()
+		}()
+
+		select {
+		case l.accepts <- c:
+		case <-l.die:
+			c.Close()
+		}
+		return nil
+	}
+	// a recorded request must not attach a path again, or make a new group
+	// of a running one
+	if req[0] == mpNewGroup || !c.joined(nonce[:mpNonceSize]) {
+		l.groupLock.Unlock()
+		return ErrPathReplayed
+	}
+	l.groupLock.Unlock()
+
+	if err := respond(mpStatusOK, c.consumed()); err != nil {
+		return err
+	}
+	return c.attach(p, peerConsumed)
+}
+
+func (l *mpListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accepts:
+		return conn, nil
+	case <-l.die:
+		return nil, ErrListenerClosed
+	}
+}
+
+func (l *mpListener) Close() error {
+	var err error
+	l.dieOnce.Do(func() {
+		close(l.die)
+		err = l.Listener.Close()
+	})
+	return err
+}
+
+// mpPath is a single connection of a multipath connection
+type mpPath struct {
+	conn  net.Conn
+	send  *mpBox // sealed under wlock, in the order frames are written
+	recv  *mpBox // opened by readPath only
+	wlock sync.Mutex
+	last  int64 // unix nano of last frame received
+}
+
+func newMPPath(conn net.Conn, send, recv *mpBox) *mpPath {
+	return &mpPath{conn: conn, send: send, recv: recv, last: time.Now().UnixNano()}
+}
+
+// writeFrame seals and writes a frame, data is only carried by mpData
+func (p *mpPath) writeFrame(cmd byte, seq uint64, data []byte) error {
+	var hdr [mpHeaderSize]byte
+	hdr[0] = cmd
+	binary.LittleEndian.PutUint64(hdr[1:9], seq)
+	binary.LittleEndian.PutUint16(hdr[9:11], uint16(len(data)))
+
+	p.wlock.Lock()
+	defer p.wlock.Unlock()
+	buf := p.send.seal(make([]byte, 0, mpHeaderSize+len(data)+2*secretbox.Overhead), hdr[:])
+	if len(data) > 0 {
+		buf = p.send.seal(buf, data)
+	}
+	_, err := p.conn.Write(buf)
+	return err
+}
+
+type mpChunk struct {
+	seq  uint64
+	data []byte
+	path *mpPath // path the chunk was last sent on, nil if it needs sending
+}
+
+// mpConn is a net.Conn striped over one or more paths
+type mpConn struct {
+	id     mpGroupID
+	local  net.Addr
+	remote net.Addr
+
+	lock  sync.Mutex
+	paths []*mpPath
+	rr    int
+	wlock sync.Mutex // serializes writers
+
+	// send side
+	sendSeq     uint64
+	unacked     []*mpChunk
+	unackedSize int
+	chAcked     chan struct{}
+
+	// receive side
+	recvSeq      uint64 // next sequence expected from peer
+	pending      map[uint64][]byte
+	readable     [][]byte // chunks up to recvSeq not read yet
+	readSinceAck int
+	chunksRead   int // since the last ack
+	chReadable   chan struct{}
+	chAck        chan struct{}
+
+	// redial adds a path to the group, client only
+	redial func() (*mpPath, uint64, error)
+	nonces map[[mpNonceSize]byte]bool // of the paths joined, server only
+
+	grace      time.Duration
+	graceTimer *time.Timer
+	log        *slog.Logger
+
+	die     chan struct{}
+	dieOnce sync.Once
+	err     atomic.Value
+}
+
+func newMPConn(id mpGroupID, p *mpPath, grace time.Duration, log *slog.Logger) *mpConn {
+	c := &mpConn{
+		id:         id,
+		grace:      grace,
+		log:        log,
+		local:      p.conn.LocalAddr(),
+		remote:     p.conn.RemoteAddr(),
+		pending:    make(map[uint64][]byte),
+		chAcked:    make(chan struct{}, 1),
+		chReadable: make(chan struct{}, 1),
+		chAck:      make(chan struct{}, 1),
+		die:        make(chan struct{}),
+	}
+	c.attach(p, 0)
+	go c.ackLoop()
+	return c
+}
+
+// consumed returns the sequence of the first chunk not fully read
+func (c *mpConn) consumed() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.recvSeq - uint64(len(c.readable))
+}
+
+// joined records the client nonce of a path, false if it was seen before
+func (c *mpConn) joined(nonce []byte) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.nonces == nil {
+		c.nonces = make(map[[mpNonceSize]byte]bool)
+	}
+	key := [mpNonceSize]byte(nonce)
+	if c.nonces[key] {
+		return false
+	}
+	c.nonces[key] = true
+	return true
+}
+
+// attach adds a path, peerConsumed acknowledges chunks read by peer
+func (c *mpConn) attach(p *mpPath, peerConsumed uint64) error {
+	if err := c.acknowledge(peerConsumed); err != nil {
+		p.conn.Close()
+		return err
+	}
+	c.lock.Lock()
+	select {
+	case <-c.die:
+		c.lock.Unlock()
+		p.conn.Close()
+		return io.ErrClosedPipe
+	default:
+	}
+	c.paths = append(c.paths, p)
+	if c.graceTimer != nil {
+		c.graceTimer.Stop()
+		c.graceTimer = nil
+		c.log.Info("Connection resumed", "remote", p.conn.RemoteAddr().String())
+	}
+	c.lock.Unlock()
+
+	go c.readPath(p)
+	c.flush()
+	return nil
+}
+
+// addPath dials a new path until it succeeds or the connection closes
+func (c *mpConn) addPath() {
+	for {
+		p, peerConsumed, err := c.redial()
+		if err == nil {
+			if err = c.attach(p, peerConsumed); err != ErrInvalidFrame {
+				return
+			}
+		}
+		if err == ErrUnknownGroup {
+			c.closeWithError(err)
+			return
+		}
+		c.log.Warn("Failed to add path", "err", err)
+
+		select {
+		case <-time.After(mpRedialInterval):
+		case <-c.die:
+			return
+		}
+	}
+}
+
+// pathFailed drops p, chunks sent on it are retransmitted on other paths
+func (c *mpConn) pathFailed(p *mpPath, err error) {
+	p.conn.Close()
+
+	c.lock.Lock()
+	found := false
+	for i := range c.paths {
+		if c.paths[i] == p {
+			c.paths = append(c.paths[:i], c.paths[i+1:]...)
+			found = true
+			break
+		}
+	}
+	if !found {
+		c.lock.Unlock()
+		return
+	}
+	for _, chunk := range c.unacked {
+		if chunk.path == p {
+			chunk.path = nil
+		}
+	}
+	remaining := len(c.paths)
+	if remaining == 0 && c.grace > 0 && c.graceTimer == nil {
+		c.graceTimer = time.AfterFunc(c.grace, c.graceExpired)
+	}
+	c.lock.Unlock()
+
+	select {
+	case <-c.die:
+		return
+	default:
+	}
+	c.log.Info("Path lost", "remote", p.conn.RemoteAddr().String(), "err", err)
+
+	if remaining == 0 {
+		if c.grace == 0 {
+			c.closeWithError(ErrNoPath)
+			return
+		}
+		c.log.Info("Waiting for connection to resume", "grace", c.grace)
+	}
+	if c.redial != nil {
+		go c.addPath()
+	}
+	c.flush()
+}
+
+// graceExpired closes the connection unless a path was reattached
+func (c *mpConn) graceExpired() {
+	c.lock.Lock()
+	resumed := len(c.paths) > 0
+	c.graceTimer = nil
+	c.lock.Unlock()
+	if !resumed {
+		c.closeWithError(ErrNoPath)
+	}
+}
+
+// pick returns the next path in round robin, nil if there is none
+func (c *mpConn) pick() *mpPath {
+	if len(c.paths) == 0 {
+		return nil
+	}
+	c.rr = (c.rr + 1) % len(c.paths)
+	return c.paths[c.rr]
+}
+
+// flush sends the chunks not assigned to a live path
+func (c *mpConn) flush() {
+	type send struct {
+		path  *mpPath
+		chunk *mpChunk
+		seq   uint64
+	}
+	var sends []send
+	c.lock.Lock()
+	for _, chunk := range c.unacked {
+		if chunk.path == nil {
+			if chunk.path = c.pick(); chunk.path == nil {
+				break
+			}
+			sends = append(sends, send{chunk.path, chunk, chunk.seq})
+		}
+	}
+	c.lock.Unlock()
+
+	for _, s := range sends {
+		if err := s.path.writeFrame(mpData, s.seq, s.chunk.data); err != nil {
+			c.pathFailed(s.path, err)
+			return
+		}
+	}
+}
+
+// acknowledge releases chunks read by peer, which cannot have read more
+// than was sent
+func (c *mpConn) acknowledge(consumed uint64) error {
+	c.lock.Lock()
+	if consumed > c.sendSeq {
+		c.lock.Unlock()
+		return ErrInvalidFrame
+	}
+	n := 0
+	for n < len(c.unacked) && c.unacked[n].seq < consumed {
+		c.unackedSize -= len(c.unacked[n].data)
+		n++
+	}
+	c.unacked = c.unacked[n:]
+	c.lock.Unlock()
+
+	if n > 0 {
+		select {
+		case c.chAcked <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// readPath reads frames from p until it fails
+func (c *mpConn) readPath(p *mpPath) {
+	r := bufio.NewReader(p.conn)
+	for {
+		hdr, err := p.recv.readFrom(r, mpHeaderSize)
+		if err != nil {
+			c.pathFailed(p, err)
+			return
+		}
+		atomic.StoreInt64(&p.last, time.Now().UnixNano())
+		seq := binary.LittleEndian.Uint64(hdr[1:9])
+		size := int(binary.LittleEndian.Uint16(hdr[9:11]))
+
+		switch hdr[0] {
+		case mpData:
+			if size == 0 || size > mpChunkSize {
+				c.pathFailed(p, ErrInvalidFrame)
+				return
+			}
+			data, err := p.recv.readFrom(r, size)
+			if err != nil {
+				c.pathFailed(p, err)
+				return
+			}
+			if err := c.receive(seq, data); err != nil {
+				c.pathFailed(p, err)
+				return
+			}
+		case mpAck:
+			if err := c.acknowledge(seq); err != nil {
+				c.pathFailed(p, err)
+				return
+			}
+		case mpFin:
+			c.closeWithError(io.EOF)
+			return
+		default:
+			c.pathFailed(p, ErrInvalidFrame)
+			return
+		}
+	}
+}
+
+// receive queues data in sequence order, chunks beyond the window of the
+// sender are refused so pending and readable stay bounded
+func (c *mpConn) receive(seq uint64, data []byte) error {
+	c.lock.Lock()
+	if seq < c.recvSeq {
+		c.lock.Unlock()
+		return nil // duplicate of a retransmitted chunk
+	}
+	if consumed := c.recvSeq - uint64(len(c.readable)); seq >= consumed+mpWindowChunks {
+		c.lock.Unlock()
+		return ErrInvalidFrame
+	}
+	c.pending[seq] = data
+	n := len(c.readable)
+	for {
+		data, ok := c.pending[c.recvSeq]
+		if !ok {
+			break
+		}
+		delete(c.pending, c.recvSeq)
+		c.readable = append(c.readable, data)
+		c.recvSeq++
+	}
+	ready := len(c.readable) > n
+	c.lock.Unlock()
+
+	if ready {
+		select {
+		case c.chReadable <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// ackLoop acknowledges read chunks, and probes and times out idle paths
+func (c *mpConn) ackLoop() {
+	ticker := time.NewTicker(mpAckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.lock.Lock()
+			paths := append([]*mpPath(nil), c.paths...)
+			c.lock.Unlock()
+			for _, p := range paths {
+				if time.Since(time.Unix(0, atomic.LoadInt64(&p.last))) > mpPathTimeout {
+					c.pathFailed(p, ErrPathTimeout)
+				}
+			}
+			c.sendAck()
+		case <-c.chAck:
+			c.sendAck()
+		case <-c.die:
+			return
+		}
+	}
+}
+
+// sendAck sends the consumed sequence on every path
+func (c *mpConn) sendAck() {
+	consumed := c.consumed()
+
+	c.lock.Lock()
+	c.readSinceAck, c.chunksRead = 0, 0
+	paths := append([]*mpPath(nil), c.paths...)
+	c.lock.Unlock()
+	for _, p := range paths {
+		if err := p.writeFrame(mpAck, consumed, nil); err != nil {
+			c.pathFailed(p, err)
+		}
+	}
+}
+
+func (c *mpConn) Read(b []byte) (int, error) {
+	for {
+		c.lock.Lock()
+		if len(c.readable) > 0 {
+			n := copy(b, c.readable[0])
+			c.readable[0] = c.readable[0][n:]
+			c.readSinceAck += n
+			ack := false
+			if len(c.readable[0]) == 0 {
+				c.readable = c.readable[1:]
+				c.chunksRead++
+				ack = c.readSinceAck >= mpWindow/4 || c.chunksRead >= mpWindowChunks/4
+			}
+			c.lock.Unlock()
+
+			if ack {
+				select {
+				case c.chAck <- struct{}{}:
+				default:
+				}
+			}
+			return n, nil
+		}
+		c.lock.Unlock()
+
+		select {
+		case <-c.chReadable:
+		case <-c.die:
+			c.lock.Lock()
+			n := len(c.readable)
+			c.lock.Unlock()
+			if n == 0 {
+				return 0, c.err.Load().(error)
+			}
+		}
+	}
+}
+
+func (c *mpConn) Write(b []byte) (int, error) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+
+	written := 0
+	for len(b) > 0 {
+		sz := len(b)
+		if sz > mpChunkSize {
+			sz = mpChunkSize
+		}
+
+		// wait for window, in bytes and in chunks
+		c.lock.Lock()
+		for c.unackedSize+sz > mpWindow || len(c.unacked) >= mpWindowChunks {
+			c.lock.Unlock()
+			select {
+			case <-c.chAcked:
+			case <-c.die:
+				return written, c.err.Load().(error)
+			}
+			c.lock.Lock()
+		}
+
+		select {
+		case <-c.die:
+			c.lock.Unlock()
+			return written, c.err.Load().(error)
+		default:
+		}
+
+		chunk := &mpChunk{seq: c.sendSeq, data: append([]byte(nil), b[:sz]...)}
+		chunk.path = c.pick()
+		c.sendSeq++
+		c.unacked = append(c.unacked, chunk)
+		c.unackedSize += sz
+		p := chunk.path
+		c.lock.Unlock()
+
+		if p != nil {
+			if err := p.writeFrame(mpData, chunk.seq, chunk.data); err != nil {
+				c.pathFailed(p, err)
+			}
+		}
+		written += sz
+		b = b[sz:]
+	}
+	return written, nil
+}
+
+func (c *mpConn) closeWithError(err error) {
+	c.dieOnce.Do(func() {
+		c.err.Store(err)
+		close(c.die)
+
+		c.lock.Lock()
+		paths := c.paths
+		c.paths = nil
+		c.lock.Unlock()
+		for _, p := range paths {
+			p.conn.Close()
+		}
+	})
+}
+
+// Close notifies peer and closes all paths
+func (c *mpConn) Close() error {
+	c.lock.Lock()
+	paths := append([]*mpPath(nil), c.paths...)
+	c.lock.Unlock()
+	for _, p := range paths {
+		p.writeFrame(mpFin, 0, nil)
+	}
+	c.closeWithError(io.ErrClosedPipe)
+	return nil
+}
+
+func (c *mpConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *mpConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// Deadlines are not supported on multipath connections
+func (c *mpConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *mpConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *mpConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
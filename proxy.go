@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/ktcunreal/toriix/smux"
+	"io"
+	"net"
+	"net/http"
+)
+
+// hop-by-hop headers, removed before forwarding a plain http request
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// bufferedConn reads through a bufio.Reader which may hold bytes
+// already read from the connection
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// serveHTTPProxy handles a CONNECT or absolute-URI request read from src,
+// carrying it to the server over a new stream
+func serveHTTPProxy(src net.Conn, session *smux.Session) error {
+	br := bufio.NewReader(src)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return err
+	}
+
+	var addr string
+	if req.Method == http.MethodConnect {
+		addr = req.Host
+	} else {
+		if !req.URL.IsAbs() || req.URL.Scheme != "http" {
+			writeHTTPStatus(src, http.StatusBadRequest)
+			return fmt.Errorf("unsupported proxy request uri %q", req.RequestURI)
+		}
+		addr = req.URL.Host
+		if req.URL.Port() == "" {
+			addr = net.JoinHostPort(req.URL.Hostname(), "80")
+		}
+	}
+
+	stream, err := openStream(session, sourceHeader(streamHeader{hdrDst: addr}, src))
+	if err != nil {
+		writeHTTPStatus(src, http.StatusBadGateway)
+		if err != smux.ErrGoAway {
+			session.Close()
+		}
+		return err
+	}
+	defer stream.Close()
+
+	if status, err := readStatus(stream); err != nil || status != statusOK {
+		writeHTTPStatus(src, http.StatusBadGateway)
+		return fmt.Errorf("proxy request to %s failed, status: %d %v", addr, status, err)
+	}
+
+	if req.Method == http.MethodConnect {
+		if _, err := io.WriteString(src, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+			return err
+		}
+	} else {
+		for _, h := range hopHeaders {
+			req.Header.Del(h)
+		}
+		req.Close = true
+		if err := req.Write(stream); err != nil {
+			return err
+		}
+	}
+
+	err1, err2 := smux.Pipe(&bufferedConn{Conn: src, r: br}, stream, 0)
+	if err1 != nil && err1 != io.EOF {
+		return err1
+	}
+	if err2 != nil && err2 != io.EOF {
+		return err2
+	}
+	return nil
+}
+
+func writeHTTPStatus(w io.Writer, code int) {
+	fmt.Fprintf(w, "HTTP/1.1 %d %s\r\nConnection: close\r\nContent-Length: 0\r\n\r\n", code, http.StatusText(code))
+}
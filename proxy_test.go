@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/ktcunreal/toriix/smux"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// sessionPair returns both ends of a session over an in-memory connection
+func sessionPair(t *testing.T) (client, server *smux.Session) {
+	return sessionPairWith(t, nil)
+}
+
+func sessionPairWith(t *testing.T, conf *smux.Config) (client, server *smux.Session) {
+	c1, c2 := net.Pipe()
+	client, err := smux.Client(c1, conf, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = smux.Server(c2, conf, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// acceptStreams passes each stream accepted on session to handle, with the
+// header it was opened with
+func acceptStreams(session *smux.Session, handle func(*smux.Stream, streamHeader)) {
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer stream.Close()
+			handle(stream, streamHeader(stream.Metadata()))
+		}()
+	}
+}
+
+// proxyStreams dials the destination requested by each stream
+func proxyStreams(session *smux.Session) {
+	acceptStreams(session, func(stream *smux.Stream, hdr streamHeader) {
+		dst, err := net.Dial("tcp", hdr[hdrDst])
+		if err != nil {
+			writeStatus(stream, statusUnreachable)
+			return
+		}
+		defer dst.Close()
+		writeStatus(stream, statusOK)
+		smux.Pipe(stream, dst, 0)
+	})
+}
+
+// proxyRequest sends req through serveHTTPProxy over session and returns
+// the connection with the response
+func proxyRequest(t *testing.T, session *smux.Session, req string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, src := net.Pipe()
+	go func() {
+		defer src.Close()
+		serveHTTPProxy(src, session)
+	}()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	go io.WriteString(conn, req)
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, r, resp
+}
+
+func TestHTTPProxy(t *testing.T) {
+	client, server := sessionPair(t)
+	go proxyStreams(server)
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Connection") != "" {
+			t.Error("hop-by-hop header forwarded")
+		}
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer web.Close()
+
+	// CONNECT tunnels raw bytes
+	conn, r, resp := proxyRequest(t, client, fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %[1]s\r\n\r\n", echo.Addr()))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT: %s", resp.Status)
+	}
+	go io.WriteString(conn, "ping\n")
+	if line, err := r.ReadString('\n'); err != nil || line != "ping\n" {
+		t.Errorf("echo = %q, %v", line, err)
+	}
+	conn.Close()
+
+	// Absolute URI requests are forwarded without hop-by-hop headers
+	conn, r, resp = proxyRequest(t, client, fmt.Sprintf("GET %s/hello HTTP/1.1\r\nHost: %s\r\nProxy-Connection: keep-alive\r\n\r\n", web.URL, web.Listener.Addr()))
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "/hello" {
+		t.Errorf("GET: %s %q", resp.Status, body)
+	}
+	conn.Close()
+
+	// Unreachable destinations and origin-form requests are refused
+	for _, req := range []string{
+		fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %[1]s\r\n\r\n", freeAddr(t)),
+		"GET /hello HTTP/1.1\r\nHost: example.com\r\n\r\n",
+	} {
+		conn, _, resp := proxyRequest(t, client, req)
+		if resp.StatusCode == http.StatusOK {
+			t.Errorf("%q: %s", req, resp.Status)
+		}
+		conn.Close()
+	}
+
+	// A session going away refuses new requests, and is kept for the
+	// running streams
+	server.GoAway()
+	<-client.GoAwayChan()
+	conn, r, resp = proxyRequest(t, client, fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %[1]s\r\n\r\n", echo.Addr()))
+	io.Copy(io.Discard, r) // until the request is done with
+	if resp.StatusCode != http.StatusBadGateway || client.IsClosed() {
+		t.Errorf("after GOAWAY: %s, closed %v", resp.Status, client.IsClosed())
+	}
+	conn.Close()
+}
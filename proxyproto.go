@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PROXY protocol v1 and v2 headers carrying the original client address,
+// https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+const (
+	proxyV1MaxSize        = 107
+	proxyHeaderTimeout    = 10 * time.Second
+	proxyV2VersionCommand = 0x20
+	proxyV2CmdLocal       = 0x0
+	proxyV2CmdProxy       = 0x1
+	proxyV2FamTCP4        = 0x11
+	proxyV2FamTCP6        = 0x21
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var (
+	ErrInvalidProxyHeader = errors.New("invalid proxy protocol header")
+)
+
+// checkProxyProtocol reports an unknown proxy_protocol version
+func checkProxyProtocol(version string) error {
+	switch version {
+	case "", "v1", "v2":
+		return nil
+	}
+	return fmt.Errorf("unknown proxy protocol version %q, available: v1, v2", version)
+}
+
+// sourceHeader adds the peer address of conn to hdr, unless it is not
+// an ip address
+func sourceHeader(hdr streamHeader, conn net.Conn) streamHeader {
+	switch addr := conn.RemoteAddr().(type) {
+	case *net.TCPAddr, *net.UDPAddr:
+		hdr[hdrSrc] = addr.String()
+	}
+	return hdr
+}
+
+// writeProxyHeader writes a PROXY protocol header from src to dst, with an
+// unknown source when either is not a tcp address
+func writeProxyHeader(w io.Writer, version string, src string, dst net.Addr) error {
+	var from, to netip.AddrPort
+	if ap, err := netip.ParseAddrPort(src); err == nil {
+		from = ap
+	}
+	if tcp, ok := dst.(*net.TCPAddr); ok {
+		to = tcp.AddrPort()
+	}
+	known := from.IsValid() && to.IsValid()
+	v4 := from.Addr().Unmap().Is4() && to.Addr().Unmap().Is4()
+
+	var buf bytes.Buffer
+	switch version {
+	case "v1":
+		switch {
+		case !known:
+			buf.WriteString("PROXY UNKNOWN\r\n")
+		case v4:
+			fmt.Fprintf(&buf, "PROXY TCP4 %s %s %d %d\r\n", from.Addr().Unmap(), to.Addr().Unmap(), from.Port(), to.Port())
+		default:
+			fmt.Fprintf(&buf, "PROXY TCP6 %s %s %d %d\r\n", as16(from.Addr()), as16(to.Addr()), from.Port(), to.Port())
+		}
+	case "v2":
+		buf.Write(proxyV2Signature)
+		switch {
+		case !known:
+			buf.Write([]byte{proxyV2VersionCommand | proxyV2CmdLocal, 0, 0, 0})
+		case v4:
+			buf.Write([]byte{proxyV2VersionCommand | proxyV2CmdProxy, proxyV2FamTCP4, 0, 12})
+			buf.Write(from.Addr().Unmap().AsSlice())
+			buf.Write(to.Addr().Unmap().AsSlice())
+			binary.Write(&buf, binary.BigEndian, [2]uint16{from.Port(), to.Port()})
+		default:
+			buf.Write([]byte{proxyV2VersionCommand | proxyV2CmdProxy, proxyV2FamTCP6, 0, 36})
+			buf.Write(as16(from.Addr()).AsSlice())
+			buf.Write(as16(to.Addr()).AsSlice())
+			binary.Write(&buf, binary.BigEndian, [2]uint16{from.Port(), to.Port()})
+		}
+	default:
+		return checkProxyProtocol(version)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func as16(addr netip.Addr) netip.Addr {
+	return netip.AddrFrom16(addr.As16())
+}
+
+// readProxyHeader reads a v1 or v2 header from r, the source address is
+// nil for headers without one
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2Header(r)
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return readProxyV1Header(r)
+	}
+	return nil, ErrInvalidProxyHeader
+}
+
+func readProxyV1Header(r *bufio.Reader) (net.Addr, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) > proxyV1MaxSize || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrInvalidProxyHeader
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrInvalidProxyHeader
+	}
+	ip, err := netip.ParseAddr(fields[2])
+	if err != nil {
+		return nil, ErrInvalidProxyHeader
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, ErrInvalidProxyHeader
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), nil
+}
+
+func readProxyV2Header(r *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[12]&0xf0 != proxyV2VersionCommand {
+		return nil, ErrInvalidProxyHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	if hdr[12]&0x0f == proxyV2CmdLocal {
+		return nil, nil
+	}
+
+	// Source address of any transport protocol, trailing TLVs are ignored
+	switch hdr[13] >> 4 {
+	case 0x1:
+		if len(body) < 12 {
+			return nil, ErrInvalidProxyHeader
+		}
+		ip, _ := netip.AddrFromSlice(body[0:4])
+		port := binary.BigEndian.Uint16(body[8:10])
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, port)), nil
+	case 0x2:
+		if len(body) < 36 {
+			return nil, ErrInvalidProxyHeader
+		}
+		ip, _ := netip.AddrFromSlice(body[0:16])
+		port := binary.BigEndian.Uint16(body[32:34])
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, port)), nil
+	}
+	return nil, nil
+}
+
+// proxyProtoListener accepts connections starting with a PROXY protocol
+// header, as forwarded by a load balancer
+type proxyProtoListener struct {
+	net.Listener
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtoConn{Conn: conn}, nil
+}
+
+// proxyProtoConn reads the header on first use, and reports the source
+// address it carries as the remote address
+type proxyProtoConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+	err    error
+	once   sync.Once
+}
+
+func (c *proxyProtoConn) readHeader() {
+	c.once.Do(func() {
+		c.r = bufio.NewReader(c.Conn)
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.remote, c.err = readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+	})
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"log/slog"
+	"net"
+	"testing"
+)
+
+func TestProxyHeader(t *testing.T) {
+	dst := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443}
+	dst6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}
+	unix := &net.UnixAddr{Name: "/run/app.sock", Net: "unix"}
+
+	tests := []struct {
+		src  string
+		dst  net.Addr
+		want string // source read back, empty for unknown
+	}{
+		{"198.51.100.7:51234", dst, "198.51.100.7:51234"},
+		{"[2001:db8::7]:51234", dst6, "[2001:db8::7]:51234"},
+		{"198.51.100.7:51234", dst6, "198.51.100.7:51234"},
+		{"", dst, ""},
+		{"198.51.100.7:51234", unix, ""},
+	}
+	for _, version := range []string{"v1", "v2"} {
+		for _, tt := range tests {
+			var buf bytes.Buffer
+			if err := writeProxyHeader(&buf, version, tt.src, tt.dst); err != nil {
+				t.Fatal(err)
+			}
+			buf.WriteString("payload")
+
+			r := bufio.NewReader(&buf)
+			src, err := readProxyHeader(r)
+			if err != nil {
+				t.Fatalf("%s %s: %v", version, tt.src, err)
+			}
+			got := ""
+			if src != nil {
+				got = src.String()
+			}
+			if got != tt.want {
+				t.Fatalf("%s: source %q, want %q", version, got, tt.want)
+			}
+			if rest, _ := r.ReadString(0); rest != "payload" {
+				t.Fatalf("%s: payload %q after header", version, rest)
+			}
+		}
+	}
+
+	if _, err := readProxyHeader(bufio.NewReader(bytes.NewBufferString("GET / HTTP/1.1\r\n\r\n"))); err != ErrInvalidProxyHeader {
+		t.Fatalf("missing header: %v", err)
+	}
+	if err := checkProxyProtocol("v3"); err == nil {
+		t.Fatal("unknown version accepted")
+	}
+}
+
+func TestProxyProtoListener(t *testing.T) {
+	tr, err := newTransport(&Config{Mode: "server", AcceptProxyProtocol: true}, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, listen := range map[string]func() (net.Listener, error){
+		"listener": func() (net.Listener, error) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			return &proxyProtoListener{ln}, err
+		},
+		// Sessions from clients behind the load balancer
+		"transport": func() (net.Listener, error) {
+			return tr.Listen("127.0.0.1:0")
+		},
+	} {
+		l, err := listen()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		go func() {
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			writeProxyHeader(conn, "v2", "203.0.113.9:4000", conn.RemoteAddr())
+			conn.Write([]byte("hello"))
+		}()
+
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if got := conn.RemoteAddr().String(); got != "203.0.113.9:4000" {
+			t.Fatalf("%s: remote address %s, want 203.0.113.9:4000", name, got)
+		}
+		hdr := sourceHeader(streamHeader{}, conn)
+		if hdr[hdrSrc] != "203.0.113.9:4000" {
+			t.Fatalf("%s: source header %q", name, hdr[hdrSrc])
+		}
+		buf := make([]byte, 5)
+		if _, err := conn.Read(buf); err != nil || string(buf) != "hello" {
+			t.Fatalf("%s: read %q, %v", name, buf, err)
+		}
+	}
+}
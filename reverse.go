@@ -0,0 +1,89 @@
+package main
+
+import (
+	"github.com/ktcunreal/toriix/smux"
+	"io"
+	"net"
+	"sync"
+)
+
+// sessionPool holds the client sessions available to reverse streams
+type sessionPool struct {
+	sessions []*smux.Session
+	lock     sync.Mutex
+}
+
+func (p *sessionPool) add(s *smux.Session) {
+	p.lock.Lock()
+	p.sessions = append(p.sessions, s)
+	p.lock.Unlock()
+}
+
+func (p *sessionPool) remove(s *smux.Session) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for i := range p.sessions {
+		if p.sessions[i] == s {
+			p.sessions = append(p.sessions[:i], p.sessions[i+1:]...)
+			return
+		}
+	}
+}
+
+// pick returns the most recently connected session which is still alive,
+// and whose client is not going away
+func (p *sessionPool) pick() *smux.Session {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for i := len(p.sessions) - 1; i >= 0; i-- {
+		select {
+		case <-p.sessions[i].CloseChan():
+		case <-p.sessions[i].GoAwayChan():
+		default:
+			return p.sessions[i]
+		}
+	}
+	return nil
+}
+
+// serveReverse accepts connections on the public listener of the server
+// and opens a stream for each of them to a client session in pool
+func (t *tunnel) serveReverse(listener net.Listener, pool *sessionPool) {
+	log := t.log
+	for {
+		src, err := listener.Accept()
+		if err != nil {
+			log.Debug("Public listener stopped", "err", err)
+			return
+		}
+		if t.paused.Load() {
+			src.Close()
+			continue
+		}
+
+		go func(src net.Conn) {
+			defer src.Close()
+			session := pool.pick()
+			if session == nil {
+				log.Warn("No client session available", "src", src.RemoteAddr().String())
+				return
+			}
+
+			stream, err := openStream(session, sourceHeader(streamHeader{}, src))
+			if err != nil {
+				session.Logger().Warn("Failed to open stream", "src", src.RemoteAddr().String(), "err", err)
+				return
+			}
+			defer stream.Close()
+			log := stream.Logger().With("src", src.RemoteAddr().String())
+			log.Debug("Forwarding")
+			err1, err2 := smux.Pipe(src, stream, 0)
+			if err1 != nil && err1 != io.EOF {
+				log.Debug("Forwarding stopped", "err", err1)
+			}
+			if err2 != nil && err2 != io.EOF {
+				log.Debug("Forwarding stopped", "err", err2)
+			}
+		}(src)
+	}
+}
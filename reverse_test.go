@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/ktcunreal/toriix/smux"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReverse(t *testing.T) {
+	public, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer public.Close()
+	pool := &sessionPool{}
+	tun := &tunnel{log: slog.Default()}
+	go tun.serveReverse(public, pool)
+
+	// Clients greet reverse streams with their name, then echo
+	var servers []*smux.Session
+	for _, name := range []string{"first", "second"} {
+		client, server := sessionPair(t)
+		name := name
+		go acceptStreams(client, func(stream *smux.Stream, hdr streamHeader) {
+			fmt.Fprintln(stream, name)
+			io.Copy(stream, stream)
+		})
+		pool.add(server)
+		servers = append(servers, server)
+	}
+
+	greeting := func() string {
+		conn, err := net.Dial("tcp", public.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			return ""
+		}
+		return line[:len(line)-1]
+	}
+
+	// The latest live session gets the streams
+	if got := greeting(); got != "second" {
+		t.Errorf("greeting = %q, want second", got)
+	}
+	tun.paused.Store(true)
+	if got := greeting(); got != "" {
+		t.Errorf("paused, greeting = %q", got)
+	}
+	tun.paused.Store(false)
+	servers[1].Close()
+	if got := greeting(); got != "first" {
+		t.Errorf("after close, greeting = %q, want first", got)
+	}
+	pool.remove(servers[0])
+	if got := greeting(); got != "" {
+		t.Errorf("empty pool, greeting = %q", got)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/ktcunreal/toriix/smux"
+	"time"
+)
+
+// SmuxConfig tunes the session multiplexing streams, omitted keys keep the
+// defaults. Durations are in seconds.
+type SmuxConfig struct {
+	Version           int  `json:"version"`
+	KeepAliveDisabled bool `json:"keepalive_disabled"`
+	KeepAliveInterval int  `json:"keepalive_interval"`
+	KeepAliveTimeout  int  `json:"keepalive_timeout"`
+	MaxFrameSize      int  `json:"max_frame_size"`
+	MaxReceiveBuffer  int  `json:"max_receive_buffer"`
+	MaxStreamBuffer   int  `json:"max_stream_buffer"`
+}
+
+// DefaultSmuxConfig returns the settings of smux.DefaultConfig
+func DefaultSmuxConfig() *SmuxConfig {
+	return newSmuxConfig(smux.DefaultConfig())
+}
+
+func newSmuxConfig(conf *smux.Config) *SmuxConfig {
+	return &SmuxConfig{
+		Version:           conf.Version,
+		KeepAliveDisabled: conf.KeepAliveDisabled,
+		KeepAliveInterval: int(conf.KeepAliveInterval / time.Second),
+		KeepAliveTimeout:  int(conf.KeepAliveTimeout / time.Second),
+		MaxFrameSize:      conf.MaxFrameSize,
+		MaxReceiveBuffer:  conf.MaxReceiveBuffer,
+		MaxStreamBuffer:   conf.MaxStreamBuffer,
+	}
+}
+
+func (s *SmuxConfig) UnmarshalJSON(b []byte) error {
+	type plain SmuxConfig
+	*s = *DefaultSmuxConfig()
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	return dec.Decode((*plain)(s))
+}
+
+// smuxConfig returns the session config of c
+func (c *Config) smuxConfig() *smux.Config {
+	conf := smux.DefaultConfig()
+	if s := c.Smux; s != nil {
+		conf.Version = s.Version
+		conf.KeepAliveDisabled = s.KeepAliveDisabled
+		conf.KeepAliveInterval = time.Duration(s.KeepAliveInterval) * time.Second
+		conf.KeepAliveTimeout = time.Duration(s.KeepAliveTimeout) * time.Second
+		conf.MaxFrameSize = s.MaxFrameSize
+		conf.MaxReceiveBuffer = s.MaxReceiveBuffer
+		conf.MaxStreamBuffer = s.MaxStreamBuffer
+	}
+
+	// Session must not time out while waiting to resume
+	conf.KeepAliveTimeout += c.resumeGrace()
+	return conf
+}
+
+// Hello exchanges the smux settings of both peers when a session starts,
+// over a stream opened by the client with its settings in hdrHello and
+// answered by the server with a line of its own. Peers log the settings
+// which do not fit together, and drop the session on a version mismatch.
+
+// sayHello runs the client side of the exchange
+func sayHello(session *smux.Session, conf *smux.Config) error {
+	local, err := json.Marshal(newSmuxConfig(conf))
+	if err != nil {
+		return err
+	}
+	stream, err := openStream(session, streamHeader{hdrHello: string(local)})
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	line, err := bufio.NewReader(stream).ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	var peer SmuxConfig
+	if err := json.Unmarshal(line, &peer); err != nil {
+		return err
+	}
+	return checkPeerSettings(session, conf, &peer)
+}
+
+// serveHello answers the hello stream of a client
+func serveHello(session *smux.Session, stream *smux.Stream, hello string, conf *smux.Config) error {
+	var peer SmuxConfig
+	if err := json.Unmarshal([]byte(hello), &peer); err != nil {
+		return err
+	}
+	local, err := json.Marshal(newSmuxConfig(conf))
+	if err != nil {
+		return err
+	}
+	if _, err := stream.Write(append(local, '\n')); err != nil {
+		return err
+	}
+	return checkPeerSettings(session, conf, &peer)
+}
+
+// checkPeerSettings logs the differences with the settings of the peer,
+// the session is closed when they are incompatible
+func checkPeerSettings(session *smux.Session, conf *smux.Config, peer *SmuxConfig) error {
+	local := newSmuxConfig(conf)
+	log := session.Logger()
+	if peer.Version != local.Version {
+		session.Close()
+		return fmt.Errorf("smux version %d, peer uses %d", local.Version, peer.Version)
+	}
+
+	if !local.KeepAliveDisabled {
+		if peer.KeepAliveDisabled {
+			log.Warn("Smux keepalive disabled on peer, idle sessions time out", "keepalive_timeout", local.KeepAliveTimeout)
+		} else if peer.KeepAliveInterval >= local.KeepAliveTimeout {
+			log.Warn("Smux keepalive interval of peer exceeds keepalive timeout, idle sessions time out",
+				"peer_keepalive_interval", peer.KeepAliveInterval, "keepalive_timeout", local.KeepAliveTimeout)
+		}
+	}
+	if peer.MaxFrameSize != local.MaxFrameSize {
+		log.Warn("Smux max frame size differs from peer", "local", local.MaxFrameSize, "peer", peer.MaxFrameSize)
+	}
+	if peer.MaxStreamBuffer != local.MaxStreamBuffer {
+		log.Warn("Smux max stream buffer differs from peer", "local", local.MaxStreamBuffer, "peer", peer.MaxStreamBuffer)
+	}
+	if peer.MaxReceiveBuffer != local.MaxReceiveBuffer {
+		log.Warn("Smux max receive buffer differs from peer", "local", local.MaxReceiveBuffer, "peer", peer.MaxReceiveBuffer)
+	}
+	return nil
+}
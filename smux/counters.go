@@ -0,0 +1,16 @@
+package smux
+
+import "sync/atomic"
+
+// Counters accumulate the traffic and failures of the sessions sharing them,
+// set Config.Counters to follow a group of sessions. Bytes are counted on
+// the underlying connection, headers included.
+type Counters struct {
+	BytesIn           atomic.Uint64
+	BytesOut          atomic.Uint64
+	FramesIn          atomic.Uint64
+	FramesOut         atomic.Uint64
+	HeaderFailures    atomic.Uint64 // ErrInvalidHeader
+	DecryptFailures   atomic.Uint64 // ErrDecryptFailed
+	KeepAliveTimeouts atomic.Uint64
+}
@@ -14,6 +14,12 @@ const ( // cmds
 	// protocol version 2 extra commands
 	// notify bytes consumed by remote peer-end
 	cmdUPD
+	// no new streams may be opened, running ones drain, any version
+	cmdGOA
+	// ping sent on keepalive, answered by a pong with the same sid,
+	// measures the round trip time, any version
+	cmdPING
+	cmdPONG
 )
 
 const (
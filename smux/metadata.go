@@ -0,0 +1,61 @@
+package smux
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+// Stream metadata is sent encrypted in the SYN frame opening a stream,
+// as entries of |1B key length|key|2B value length|value|
+const (
+	MaxMetadataSize = 16384
+)
+
+var (
+	ErrMetadataTooLarge = errors.New("stream metadata too large")
+	ErrInvalidMetadata  = errors.New("invalid stream metadata")
+)
+
+func encodeMetadata(md map[string]string) ([]byte, error) {
+	keys := make([]string, 0, len(md))
+	for k := range md {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf []byte
+	for _, k := range keys {
+		v := md[k]
+		if len(k) > 255 || len(v) > MaxMetadataSize {
+			return nil, ErrMetadataTooLarge
+		}
+		buf = append(buf, byte(len(k)))
+		buf = append(buf, k...)
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(len(v)))
+		buf = append(buf, v...)
+	}
+	if len(buf) > MaxMetadataSize {
+		return nil, ErrMetadataTooLarge
+	}
+	return buf, nil
+}
+
+func decodeMetadata(b []byte) (map[string]string, error) {
+	md := make(map[string]string)
+	for len(b) > 0 {
+		kl := int(b[0])
+		if len(b) < 1+kl+2 {
+			return nil, ErrInvalidMetadata
+		}
+		k := string(b[1 : 1+kl])
+		b = b[1+kl:]
+		vl := int(binary.LittleEndian.Uint16(b))
+		if len(b) < 2+vl {
+			return nil, ErrInvalidMetadata
+		}
+		md[k] = string(b[2 : 2+vl])
+		b = b[2+vl:]
+	}
+	return md, nil
+}
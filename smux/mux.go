@@ -8,6 +8,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"math"
 	"time"
 )
@@ -38,13 +39,20 @@ type Config struct {
 	// MaxStreamBuffer is used to control the maximum
 	// number of data per stream
 	MaxStreamBuffer int
+
+	// Logger receives the events of the session and its streams, with
+	// the session and stream IDs as fields. Nil discards them.
+	Logger *slog.Logger
+
+	// Counters, when set, accumulate the traffic of the session
+	Counters *Counters
 }
 
 // DefaultConfig is used to return a default configuration
 func DefaultConfig() *Config {
 	return &Config{
 		Version:           1,
-		KeepAliveInterval: 10 * time.Second,
+		KeepAliveInterval: 20 * time.Second,
 		KeepAliveTimeout:  30 * time.Second,
 		MaxFrameSize:      32768,
 		MaxReceiveBuffer:  48388608,
@@ -6,8 +6,9 @@ import (
 	"golang.org/x/crypto/nacl/secretbox"
 	"io"
 	"github.com/mroth/jitter"
-	// "log"
+	"log/slog"
 	"net"	
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -30,13 +31,16 @@ const (
 var (
 	ErrInvalidProtocol = errors.New("invalid protocol")
 	ErrConsumed        = errors.New("peer consumed more than sent")
-	ErrGoAway          = errors.New("stream id overflows, should start a new connection")
+	ErrGoAway          = errors.New("session is going away, should start a new connection")
 	ErrTimeout         = errors.New("timeout")
 	ErrWouldBlock      = errors.New("operation would block on IO")
 	ErrInvalidHeader   = errors.New("header decryption failed")
 	ErrDecryptFailed   = errors.New("data decryption failed")
 )
 
+// sessionIDs numbers the sessions of the process, for logging
+var sessionIDs uint64
+
 type writeRequest struct {
 	class  CLASSID
 	frame  Frame
@@ -52,6 +56,8 @@ type writeResult struct {
 // / Session defines a multiplexed connection for streams
 type Session struct {
 	conn io.ReadWriteCloser
+	id   uint64
+	log  *slog.Logger
 
 	config           *Config
 	nextStreamID     uint32 // next stream identifier
@@ -60,6 +66,17 @@ type Session struct {
 	bucket       int32         // token bucket
 	bucketNotify chan struct{} // used for waiting for tokens
 
+	shaperQueue int32 // frames waiting in the shaper
+
+	stats        Counters  // traffic of this session
+	shared       *Counters // Config.Counters
+	created      time.Time
+	lastActivity int64 // unix nanoseconds of the last frame in or out
+
+	pingID   uint32 // sid of the last ping sent
+	pingSent int64  // unix nanoseconds the last ping was sent
+	rtt      int64  // smoothed round trip time, nanoseconds
+
 	streams    map[uint32]*Stream // all streams in this session
 	streamLock sync.Mutex         // locks streams
 
@@ -83,7 +100,12 @@ type Session struct {
 
 	dataReady int32 // flag data has arrived
 
-	goAway int32 // flag id exhausted
+	goAway int32 // flag id exhausted, or going away
+
+	unlockKA int32 // flag the peer proved it has the key, keepalive may start
+
+	chGoAway   chan struct{} // closed when the peer sent GOAWAY
+	goAwayOnce sync.Once
 
 	deadline atomic.Value
 
@@ -92,7 +114,6 @@ type Session struct {
 	writes    chan writeRequest
 
 	isClient                               bool
-	UnlockKA                               bool
 	ServerSN, ServerRN, ClientSN, ClientRN [24]byte
 	NaclKey                                [32]byte
 	keyring                                *Keyring
@@ -102,6 +123,7 @@ func newSession(config *Config, conn io.ReadWriteCloser, client bool, key string
 	s := new(Session)
 	s.die = make(chan struct{})
 	s.conn = conn
+	s.id = atomic.AddUint64(&sessionIDs, 1)
 	s.config = config
 	s.streams = make(map[uint32]*Stream)
 	s.chAccepts = make(chan *Stream, defaultAcceptBacklog)
@@ -112,6 +134,7 @@ func newSession(config *Config, conn io.ReadWriteCloser, client bool, key string
 	s.chSocketReadError = make(chan struct{})
 	s.chSocketWriteError = make(chan struct{})
 	s.chProtoError = make(chan struct{})
+	s.chGoAway = make(chan struct{})
 	s.keyring = NewKeyring(key)
 	copy(s.NaclKey[:], s.keyring.Extract(nil, "nacl"))
 
@@ -123,6 +146,20 @@ func newSession(config *Config, conn io.ReadWriteCloser, client bool, key string
 		s.isClient = false
 	}
 
+	s.shared = config.Counters
+	s.created = time.Now()
+	s.lastActivity = s.created.UnixNano()
+
+	logger := config.Logger
+	if logger == nil {
+		logger = slog.New(discardHandler{})
+	}
+	s.log = logger.With("session", s.id)
+	if addr := s.RemoteAddr(); addr != nil {
+		s.log = s.log.With("remote", addr.String())
+	}
+	s.log.Debug("Session started", "client", client)
+
 	go s.shaperLoop()
 	go s.recvLoop()
 	go s.sendLoop()
@@ -134,9 +171,19 @@ func newSession(config *Config, conn io.ReadWriteCloser, client bool, key string
 
 // OpenStream is used to create a new stream
 func (s *Session) OpenStream() (*Stream, error) {
+	return s.OpenStreamWithMetadata(nil)
+}
+
+// OpenStreamWithMetadata creates a new stream carrying md to the peer,
+// which reads it from the accepted stream with Metadata
+func (s *Session) OpenStreamWithMetadata(md map[string]string) (*Stream, error) {
 	if s.IsClosed() {
 		return nil, io.ErrClosedPipe
 	}
+	data, err := encodeMetadata(md)
+	if err != nil {
+		return nil, err
+	}
 
 	// generate stream id
 	s.nextStreamIDLock.Lock()
@@ -155,24 +202,36 @@ func (s *Session) OpenStream() (*Stream, error) {
 	s.nextStreamIDLock.Unlock()
 
 	stream := newStream(sid, s.config.MaxFrameSize, s)
+	stream.metadata = md
 
-	if _, err := s.writeFrame(newFrame(byte(s.config.Version), cmdSYN, sid)); err != nil {
-		return nil, err
-	}
-
+	// Register the stream before its SYN is sent, the peer has the metadata
+	// and may write to it as soon as it is accepted
 	s.streamLock.Lock()
-	defer s.streamLock.Unlock()
 	select {
 	case <-s.chSocketReadError:
+		s.streamLock.Unlock()
 		return nil, s.socketReadError.Load().(error)
 	case <-s.chSocketWriteError:
+		s.streamLock.Unlock()
 		return nil, s.socketWriteError.Load().(error)
 	case <-s.die:
+		s.streamLock.Unlock()
 		return nil, io.ErrClosedPipe
 	default:
 		s.streams[sid] = stream
-		return stream, nil
 	}
+	s.streamLock.Unlock()
+
+	frame := newFrame(byte(s.config.Version), cmdSYN, sid)
+	frame.data = data
+	if _, err := s.writeFrame(frame); err != nil {
+		s.streamLock.Lock()
+		delete(s.streams, sid)
+		s.streamLock.Unlock()
+		return nil, err
+	}
+	stream.Logger().Debug("Stream opened")
+	return stream, nil
 }
 
 // Open returns a generic ReadWriteCloser
@@ -218,6 +277,7 @@ func (s *Session) Close() error {
 	})
 
 	if once {
+		s.log.Debug("Session closed")
 		s.streamLock.Lock()
 		for k := range s.streams {
 			s.streams[k].sessionClose()
@@ -229,6 +289,35 @@ func (s *Session) Close() error {
 	}
 }
 
+// GoAway tells the peer to stop opening streams on this session, the
+// running streams carry on until they close. No more streams can be opened
+// on either side afterwards.
+func (s *Session) GoAway() error {
+	s.nextStreamIDLock.Lock()
+	s.goAway = 1
+	s.nextStreamIDLock.Unlock()
+	s.log.Debug("Sending GOAWAY")
+	_, err := s.writeFrame(newFrame(byte(s.config.Version), cmdGOA, 0))
+	return err
+}
+
+// GoAwayChan is closed when the peer sent GOAWAY, new streams should be
+// opened on another session
+func (s *Session) GoAwayChan() <-chan struct{} {
+	return s.chGoAway
+}
+
+// ID returns the number of the session, unique in the process
+func (s *Session) ID() uint64 {
+	return s.id
+}
+
+// Logger returns the logger of the session, with its ID and remote address
+// as fields
+func (s *Session) Logger() *slog.Logger {
+	return s.log
+}
+
 // CloseChan can be used by someone who wants to be notified immediately when this
 // session is closed
 func (s *Session) CloseChan() <-chan struct{} {
@@ -245,6 +334,11 @@ func (s *Session) notifyBucket() {
 
 func (s *Session) notifyReadError(err error) {
 	s.socketReadErrorOnce.Do(func() {
+		if err == ErrInvalidHeader || err == ErrDecryptFailed {
+			s.log.Warn("Session read failed, wrong key or tampered data", "err", err)
+		} else if !s.IsClosed() {
+			s.log.Debug("Session read failed", "err", err)
+		}
 		s.socketReadError.Store(err)
 		close(s.chSocketReadError)
 	})
@@ -252,6 +346,9 @@ func (s *Session) notifyReadError(err error) {
 
 func (s *Session) notifyWriteError(err error) {
 	s.socketWriteErrorOnce.Do(func() {
+		if !s.IsClosed() {
+			s.log.Debug("Session write failed", "err", err)
+		}
 		s.socketWriteError.Store(err)
 		close(s.chSocketWriteError)
 	})
@@ -259,6 +356,7 @@ func (s *Session) notifyWriteError(err error) {
 
 func (s *Session) notifyProtoError(err error) {
 	s.protoErrorOnce.Do(func() {
+		s.log.Warn("Session protocol error", "err", err)
 		s.protoError.Store(err)
 		close(s.chProtoError)
 	})
@@ -284,6 +382,18 @@ func (s *Session) NumStreams() int {
 	return len(s.streams)
 }
 
+// Streams returns the currently open streams, in the order they were opened
+func (s *Session) Streams() []*Stream {
+	s.streamLock.Lock()
+	streams := make([]*Stream, 0, len(s.streams))
+	for _, stream := range s.streams {
+		streams = append(streams, stream)
+	}
+	s.streamLock.Unlock()
+	sort.Slice(streams, func(i, j int) bool { return streams[i].id < streams[j].id })
+	return streams
+}
+
 // SetDeadline sets a deadline used by Accept* calls.
 // A zero time value disables the deadline.
 func (s *Session) SetDeadline(t time.Time) error {
@@ -336,7 +446,6 @@ func (s *Session) recvLoop() {
 	ehdr := NewEncryptedHeader(s.keyring)
 
 	for {
-		// log.Printf("dbg msg: atomic.LoadInt32(&s.bucket): %v s.IsClosed():%v\n", atomic.LoadInt32(&s.bucket),s.IsClosed() )
 		for atomic.LoadInt32(&s.bucket) <= 0 && !s.IsClosed() {
 			select {
 			case <-s.bucketNotify:
@@ -348,11 +457,13 @@ func (s *Session) recvLoop() {
 		// read header first
 		if _, err := io.ReadFull(s.conn, ehdr.eb[:]); err == nil {
 			atomic.StoreInt32(&s.dataReady, 1)
+			s.countIn(encryptedHeaderSize, 1)
 
 			ehdr.Mask()
 
 			// Check integrity
 			if ok := ehdr.ValidEncryptedHeader(); !ok {
+				s.count(func(c *Counters) { c.HeaderFailures.Add(1) })
 				s.notifyReadError(ErrInvalidHeader)
 				return
 			}
@@ -363,10 +474,32 @@ func (s *Session) recvLoop() {
 			switch ehdr.CMD() {
 			case cmdNOP:
 			case cmdSYN:
+				var md map[string]string
+				if ehdr.Length() > 0 {
+					ebuf := make([]byte, ehdr.Length())
+					if _, err := io.ReadFull(s.conn, ebuf); err != nil {
+						s.notifyReadError(err)
+						return
+					}
+					s.countIn(len(ebuf), 0)
+					plain, ok := s.openBox(ebuf)
+					if !ok {
+						s.count(func(c *Counters) { c.DecryptFailures.Add(1) })
+						s.notifyReadError(ErrDecryptFailed)
+						return
+					}
+					if md, err = decodeMetadata(plain); err != nil {
+						s.notifyProtoError(err)
+						return
+					}
+				}
+
 				s.streamLock.Lock()
 				if _, ok := s.streams[sid]; !ok {
 					stream := newStream(sid, s.config.MaxFrameSize, s)
+					stream.metadata = md
 					s.streams[sid] = stream
+					stream.Logger().Debug("Stream accepted")
 					select {
 					case s.chAccepts <- stream:
 					case <-s.die:
@@ -384,25 +517,12 @@ func (s *Session) recvLoop() {
 				if ehdr.Length() > 0 {
 					ebuf := defaultAllocator.Get(int(ehdr.Length()))
 					if written, err := io.ReadFull(s.conn, ebuf); err == nil {
-						var plain []byte
-						var ok bool
-
-						if s.isClient {
-							plain, ok = secretbox.Open(nil, ebuf[:], &s.ClientRN, &s.NaclKey)
-							if !ok {
-								s.notifyReadError(ErrDecryptFailed)
-								break
-							}
-							increment(&s.ClientRN)
-							s.UnlockKA = true
-						} else {
-							plain, ok = secretbox.Open(nil, ebuf[:], &s.ServerRN, &s.NaclKey)
-							if !ok {
-								s.notifyReadError(ErrDecryptFailed)
-								break
-							}
-							increment(&s.ServerRN)
-							s.UnlockKA = true
+						s.countIn(written, 0)
+						plain, ok := s.openBox(ebuf)
+						if !ok {
+							s.count(func(c *Counters) { c.DecryptFailures.Add(1) })
+							s.notifyReadError(ErrDecryptFailed)
+							break
 						}
 
 						s.streamLock.Lock()
@@ -418,8 +538,21 @@ func (s *Session) recvLoop() {
 						return
 					}
 				}
+			case cmdGOA:
+				s.nextStreamIDLock.Lock()
+				s.goAway = 1
+				s.nextStreamIDLock.Unlock()
+				s.goAwayOnce.Do(func() {
+					s.log.Debug("Peer sent GOAWAY")
+					close(s.chGoAway)
+				})
+			case cmdPING:
+				go s.writeFrame(newFrame(byte(s.config.Version), cmdPONG, sid))
+			case cmdPONG:
+				s.pong(sid)
 			case cmdUPD:
 				if _, err := io.ReadFull(s.conn, updHdr[:]); err == nil {
+					s.countIn(len(updHdr), 0)
 					s.streamLock.Lock()
 					if stream, ok := s.streams[sid]; ok {
 						stream.update(updHdr.Consumed(), updHdr.Window())
@@ -441,16 +574,16 @@ func (s *Session) recvLoop() {
 }
 
 func (s *Session) keepalive() {
-	// tickerPing := time.NewTicker(s.config.KeepAliveInterval)
-	tickerPing := jitter.NewTicker(time.Second * 20, 0.35)
+	// pings are jittered so they do not form a recognizable pattern
+	tickerPing := jitter.NewTicker(s.config.KeepAliveInterval, 0.35)
 	tickerTimeout := time.NewTicker(s.config.KeepAliveTimeout)
 	defer tickerPing.Stop()
 	defer tickerTimeout.Stop()
 	for {
 		select {
 		case <-tickerPing.C:
-			if s.UnlockKA {
-				s.writeFrameInternal(newFrame(byte(s.config.Version), cmdNOP, 0), tickerPing.C, CLSCTRL)
+			if atomic.LoadInt32(&s.unlockKA) == 1 {
+				s.writeFrameInternal(s.ping(), tickerPing.C, CLSCTRL)
 				s.notifyBucket() // force a signal to the recvLoop
 			}
 		case <-tickerTimeout.C:
@@ -458,6 +591,8 @@ func (s *Session) keepalive() {
 				// recvLoop may block while bucket is 0, in this case,
 				// session should not be closed.
 				if atomic.LoadInt32(&s.bucket) > 0 {
+					s.count(func(c *Counters) { c.KeepAliveTimeouts.Add(1) })
+					s.log.Info("Session keepalive timed out")
 					s.Close()
 					return
 				}
@@ -483,6 +618,11 @@ func (s *Session) shaperLoop() {
 		} else {
 			chWrite = nil
 		}
+		queued := len(reqs)
+		if chWrite != nil {
+			queued++
+		}
+		atomic.StoreInt32(&s.shaperQueue, int32(queued))
 
 		// control heap size, chShaper is not available until packets are less than maximum allowed
 		if len(reqs) >= maxShaperSize {
@@ -510,7 +650,7 @@ func (s *Session) shaperLoop() {
 }
 
 func (s *Session) sendLoop() {
-	var n int
+	var n, wire int
 	var err error
 	ehdr := NewEncryptedHeader(s.keyring)
 	for {
@@ -518,17 +658,10 @@ func (s *Session) sendLoop() {
 		case <-s.die:
 			return
 		case request := <-s.writes:
-			// Process payload by cmd
-			if request.frame.cmd == 2 {
-				var cipher []byte
+			// Process payload by cmd, data and stream metadata are encrypted
+			if request.frame.cmd == cmdPSH || (request.frame.cmd == cmdSYN && len(request.frame.data) > 0) {
 				// Encrypt data block
-				if s.isClient {
-					cipher = secretbox.Seal([]byte{}, request.frame.data, &s.ClientSN, &s.NaclKey)
-					increment(&s.ClientSN)
-				} else {
-					cipher = secretbox.Seal([]byte{}, request.frame.data, &s.ServerSN, &s.NaclKey)
-					increment(&s.ServerSN)
-				}
+				cipher := s.sealBox(request.frame.data)
 
 				// Set Header
 				ehdr.SetEncryptedHeader(request.frame.cmd, request.frame.sid, uint16(len(cipher)))
@@ -540,7 +673,7 @@ func (s *Session) sendLoop() {
 				copy(buf[encryptedHeaderSize:], cipher)
 
 				// Write via conn
-				_, err = s.conn.Write(buf[:encryptedHeaderSize+len(cipher)])
+				wire, err = s.conn.Write(buf[:encryptedHeaderSize+len(cipher)])
 
 				// Set wrote bytes
 				n = len(request.frame.data)
@@ -552,6 +685,7 @@ func (s *Session) sendLoop() {
 				ehdr.Mask()
 
 				n, err = s.conn.Write(ehdr.eb[:encryptedHeaderSize])
+				wire = n
 
 				// Set wrote bytes, subtract raw header size from n
 				n -= headerSize
@@ -568,7 +702,8 @@ func (s *Session) sendLoop() {
 				copy(buf[encryptedHeaderSize:], request.frame.data)
 
 				// Write via conn
-				n, err = s.conn.Write(ehdr.eb[:encryptedHeaderSize+len(request.frame.data)])
+				n, err = s.conn.Write(buf)
+				wire = n
 
 				// Set wrote bytes, subtract raw header size from n
 				n -= headerSize
@@ -577,6 +712,12 @@ func (s *Session) sendLoop() {
 				}
 			}
 
+			if err == nil {
+				s.countOut(wire, 1)
+			} else {
+				s.countOut(wire, 0)
+			}
+
 			result := writeResult{
 				n:   n,
 				err: err,
@@ -594,6 +735,31 @@ func (s *Session) sendLoop() {
 	}
 }
 
+// sealBox encrypts a frame payload with the send nonce of this side
+func (s *Session) sealBox(plain []byte) []byte {
+	sn := &s.ServerSN
+	if s.isClient {
+		sn = &s.ClientSN
+	}
+	cipher := secretbox.Seal([]byte{}, plain, sn, &s.NaclKey)
+	increment(sn)
+	return cipher
+}
+
+// openBox decrypts a frame payload with the receive nonce of this side
+func (s *Session) openBox(cipher []byte) ([]byte, bool) {
+	rn := &s.ServerRN
+	if s.isClient {
+		rn = &s.ClientRN
+	}
+	plain, ok := secretbox.Open(nil, cipher, rn, &s.NaclKey)
+	if ok {
+		increment(rn)
+		atomic.StoreInt32(&s.unlockKA, 1)
+	}
+	return plain, ok
+}
+
 // writeFrame writes the frame to the underlying connection
 // and returns the number of bytes written if successful
 func (s *Session) writeFrame(f Frame) (n int, err error) {
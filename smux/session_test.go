@@ -13,10 +13,13 @@ import (
 	_ "net/http/pprof"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
+const testKey = "some-long-password-for-tests"
+
 func init() {
 	go func() {
 		log.Println(http.ListenAndServe("0.0.0.0:6060", nil))
@@ -48,7 +51,7 @@ func setupServer(tb testing.TB) (addr string, stopfunc func(), client net.Conn,
 }
 
 func handleConnection(conn net.Conn) {
-	session, _ := Server(conn, nil)
+	session, _ := Server(conn, nil, testKey)
 	for {
 		if stream, err := session.AcceptStream(); err == nil {
 			go func(s io.ReadWriteCloser) {
@@ -94,7 +97,7 @@ func setupServerV2(tb testing.TB) (addr string, stopfunc func(), client net.Conn
 func handleConnectionV2(conn net.Conn) {
 	config := DefaultConfig()
 	config.Version = 2
-	session, _ := Server(conn, config)
+	session, _ := Server(conn, config, testKey)
 	for {
 		if stream, err := session.AcceptStream(); err == nil {
 			go func(s io.ReadWriteCloser) {
@@ -119,7 +122,7 @@ func TestEcho(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer stop()
-	session, _ := Client(cli, nil)
+	session, _ := Client(cli, nil, testKey)
 	stream, _ := session.OpenStream()
 	const N = 100
 	buf := make([]byte, 10)
@@ -155,7 +158,7 @@ func TestWriteTo(t *testing.T) {
 		if err != nil {
 			return
 		}
-		session, _ := Server(conn, nil)
+		session, _ := Server(conn, nil, testKey)
 		for {
 			if stream, err := session.AcceptStream(); err == nil {
 				go func(s io.ReadWriteCloser) {
@@ -189,7 +192,7 @@ func TestWriteTo(t *testing.T) {
 	defer conn.Close()
 
 	// client
-	session, _ := Client(conn, nil)
+	session, _ := Client(conn, nil, testKey)
 	stream, _ := session.OpenStream()
 	sndbuf := make([]byte, N)
 	for i := range sndbuf {
@@ -229,7 +232,7 @@ func TestWriteToV2(t *testing.T) {
 		if err != nil {
 			return
 		}
-		session, _ := Server(conn, config)
+		session, _ := Server(conn, config, testKey)
 		for {
 			if stream, err := session.AcceptStream(); err == nil {
 				go func(s io.ReadWriteCloser) {
@@ -263,7 +266,7 @@ func TestWriteToV2(t *testing.T) {
 	defer conn.Close()
 
 	// client
-	session, _ := Client(conn, config)
+	session, _ := Client(conn, config, testKey)
 	stream, _ := session.OpenStream()
 	sndbuf := make([]byte, N)
 	for i := range sndbuf {
@@ -298,7 +301,7 @@ func TestGetDieCh(t *testing.T) {
 		select {
 		case <-dieCh:
 		case <-time.Tick(time.Second):
-			t.Fatal("wait die chan timeout")
+			t.Error("wait die chan timeout")
 		}
 	}()
 	cs.Close()
@@ -310,7 +313,7 @@ func TestSpeed(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer stop()
-	session, _ := Client(cli, nil)
+	session, _ := Client(cli, nil, testKey)
 	stream, _ := session.OpenStream()
 	t.Log(stream.LocalAddr(), stream.RemoteAddr())
 
@@ -350,7 +353,7 @@ func TestParallel(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer stop()
-	session, _ := Client(cli, nil)
+	session, _ := Client(cli, nil, testKey)
 
 	par := 1000
 	messages := 100
@@ -384,7 +387,7 @@ func TestParallelV2(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer stop()
-	session, _ := Client(cli, config)
+	session, _ := Client(cli, config, testKey)
 
 	par := 1000
 	messages := 100
@@ -416,7 +419,7 @@ func TestCloseThenOpen(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer stop()
-	session, _ := Client(cli, nil)
+	session, _ := Client(cli, nil, testKey)
 	session.Close()
 	if _, err := session.OpenStream(); err == nil {
 		t.Fatal("opened after close")
@@ -429,7 +432,7 @@ func TestSessionDoubleClose(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer stop()
-	session, _ := Client(cli, nil)
+	session, _ := Client(cli, nil, testKey)
 	session.Close()
 	if err := session.Close(); err == nil {
 		t.Fatal("session double close doesn't return error")
@@ -442,7 +445,7 @@ func TestStreamDoubleClose(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer stop()
-	session, _ := Client(cli, nil)
+	session, _ := Client(cli, nil, testKey)
 	stream, _ := session.OpenStream()
 	stream.Close()
 	if err := stream.Close(); err == nil {
@@ -457,7 +460,7 @@ func TestConcurrentClose(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer stop()
-	session, _ := Client(cli, nil)
+	session, _ := Client(cli, nil, testKey)
 	numStreams := 100
 	streams := make([]*Stream, 0, numStreams)
 	var wg sync.WaitGroup
@@ -483,7 +486,7 @@ func TestTinyReadBuffer(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer stop()
-	session, _ := Client(cli, nil)
+	session, _ := Client(cli, nil, testKey)
 	stream, _ := session.OpenStream()
 	const N = 100
 	tinybuf := make([]byte, 6)
@@ -519,7 +522,7 @@ func TestIsClose(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer stop()
-	session, _ := Client(cli, nil)
+	session, _ := Client(cli, nil, testKey)
 	session.Close()
 	if !session.IsClosed() {
 		t.Fatal("still open after close")
@@ -545,7 +548,7 @@ func TestKeepAliveTimeout(t *testing.T) {
 	config := DefaultConfig()
 	config.KeepAliveInterval = time.Second
 	config.KeepAliveTimeout = 2 * time.Second
-	session, _ := Client(cli, config)
+	session, _ := Client(cli, config, testKey)
 	time.Sleep(3 * time.Second)
 	if !session.IsClosed() {
 		t.Fatal("keepalive-timeout failed")
@@ -583,7 +586,7 @@ func TestKeepAliveBlockWriteTimeout(t *testing.T) {
 	config := DefaultConfig()
 	config.KeepAliveInterval = time.Second
 	config.KeepAliveTimeout = 2 * time.Second
-	session, _ := Client(blockWriteCli, config)
+	session, _ := Client(blockWriteCli, config, testKey)
 	time.Sleep(3 * time.Second)
 	if !session.IsClosed() {
 		t.Fatal("keepalive-timeout failed")
@@ -603,7 +606,7 @@ func TestServerEcho(t *testing.T) {
 				return err
 			}
 			defer conn.Close()
-			session, err := Server(conn, nil)
+			session, err := Server(conn, nil, testKey)
 			if err != nil {
 				return err
 			}
@@ -637,7 +640,7 @@ func TestServerEcho(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer cli.Close()
-	if session, err := Client(cli, nil); err == nil {
+	if session, err := Client(cli, nil, testKey); err == nil {
 		if stream, err := session.AcceptStream(); err == nil {
 			buf := make([]byte, 65536)
 			for {
@@ -661,7 +664,7 @@ func TestSendWithoutRecv(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer stop()
-	session, _ := Client(cli, nil)
+	session, _ := Client(cli, nil, testKey)
 	stream, _ := session.OpenStream()
 	const N = 100
 	for i := 0; i < N; i++ {
@@ -681,7 +684,7 @@ func TestWriteAfterClose(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer stop()
-	session, _ := Client(cli, nil)
+	session, _ := Client(cli, nil, testKey)
 	stream, _ := session.OpenStream()
 	stream.Close()
 	if _, err := stream.Write([]byte("write after close")); err == nil {
@@ -695,7 +698,7 @@ func TestReadStreamAfterSessionClose(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer stop()
-	session, _ := Client(cli, nil)
+	session, _ := Client(cli, nil, testKey)
 	stream, _ := session.OpenStream()
 	session.Close()
 	buf := make([]byte, 10)
@@ -712,7 +715,7 @@ func TestWriteStreamAfterConnectionClose(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer stop()
-	session, _ := Client(cli, nil)
+	session, _ := Client(cli, nil, testKey)
 	stream, _ := session.OpenStream()
 	session.conn.Close()
 	if _, err := stream.Write([]byte("write after connection close")); err == nil {
@@ -726,7 +729,7 @@ func TestNumStreamAfterClose(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer stop()
-	session, _ := Client(cli, nil)
+	session, _ := Client(cli, nil, testKey)
 	if _, err := session.OpenStream(); err == nil {
 		if session.NumStreams() != 1 {
 			t.Fatal("wrong number of streams after opened")
@@ -748,7 +751,7 @@ func TestRandomFrame(t *testing.T) {
 	}
 	defer stop()
 	// pure random
-	session, _ := Client(cli, nil)
+	session, _ := Client(cli, nil, testKey)
 	for i := 0; i < 100; i++ {
 		rnd := make([]byte, rand.Uint32()%1024)
 		io.ReadFull(crand.Reader, rnd)
@@ -761,7 +764,7 @@ func TestRandomFrame(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	session, _ = Client(cli, nil)
+	session, _ = Client(cli, nil, testKey)
 	for i := 0; i < 100; i++ {
 		f := newFrame(1, cmdSYN, 1000)
 		session.writeFrame(f)
@@ -774,7 +777,7 @@ func TestRandomFrame(t *testing.T) {
 		t.Fatal(err)
 	}
 	allcmds := []byte{cmdSYN, cmdFIN, cmdPSH, cmdNOP}
-	session, _ = Client(cli, nil)
+	session, _ = Client(cli, nil, testKey)
 	for i := 0; i < 100; i++ {
 		f := newFrame(1, allcmds[rand.Int()%len(allcmds)], rand.Uint32())
 		session.writeFrame(f)
@@ -786,7 +789,7 @@ func TestRandomFrame(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	session, _ = Client(cli, nil)
+	session, _ = Client(cli, nil, testKey)
 	for i := 0; i < 100; i++ {
 		f := newFrame(1, byte(rand.Uint32()), rand.Uint32())
 		session.writeFrame(f)
@@ -798,7 +801,7 @@ func TestRandomFrame(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	session, _ = Client(cli, nil)
+	session, _ = Client(cli, nil, testKey)
 	for i := 0; i < 100; i++ {
 		f := newFrame(1, byte(rand.Uint32()), rand.Uint32())
 		f.ver = byte(rand.Uint32())
@@ -811,7 +814,7 @@ func TestRandomFrame(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	session, _ = Client(cli, nil)
+	session, _ = Client(cli, nil, testKey)
 
 	f := newFrame(1, byte(rand.Uint32()), rand.Uint32())
 	rnd := make([]byte, rand.Uint32()%1024)
@@ -833,7 +836,7 @@ func TestRandomFrame(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	session, _ = Client(cli, nil)
+	session, _ = Client(cli, nil, testKey)
 	//close first
 	session.Close()
 	for i := 0; i < 100; i++ {
@@ -849,7 +852,7 @@ func TestWriteFrameInternal(t *testing.T) {
 	}
 	defer stop()
 	// pure random
-	session, _ := Client(cli, nil)
+	session, _ := Client(cli, nil, testKey)
 	for i := 0; i < 100; i++ {
 		rnd := make([]byte, rand.Uint32()%1024)
 		io.ReadFull(crand.Reader, rnd)
@@ -862,7 +865,7 @@ func TestWriteFrameInternal(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	session, _ = Client(cli, nil)
+	session, _ = Client(cli, nil, testKey)
 	//close first
 	session.Close()
 	for i := 0; i < 100; i++ {
@@ -876,7 +879,7 @@ func TestWriteFrameInternal(t *testing.T) {
 		t.Fatal(err)
 	}
 	allcmds := []byte{cmdSYN, cmdFIN, cmdPSH, cmdNOP}
-	session, _ = Client(cli, nil)
+	session, _ = Client(cli, nil, testKey)
 	for i := 0; i < 100; i++ {
 		f := newFrame(1, allcmds[rand.Int()%len(allcmds)], rand.Uint32())
 		session.writeFrameInternal(f, time.After(session.config.KeepAliveTimeout), CLSDATA)
@@ -901,7 +904,7 @@ func TestWriteFrameInternal(t *testing.T) {
 		config := DefaultConfig()
 		config.KeepAliveInterval = time.Second
 		config.KeepAliveTimeout = 2 * time.Second
-		session, _ = Client(&blockWriteConn{cli}, config)
+		session, _ = Client(&blockWriteConn{cli}, config, testKey)
 		f := newFrame(1, byte(rand.Uint32()), rand.Uint32())
 		c := make(chan time.Time)
 		go func() {
@@ -924,7 +927,7 @@ func TestReadDeadline(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer stop()
-	session, _ := Client(cli, nil)
+	session, _ := Client(cli, nil, testKey)
 	stream, _ := session.OpenStream()
 	const N = 100
 	buf := make([]byte, 10)
@@ -951,7 +954,7 @@ func TestWriteDeadline(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer stop()
-	session, _ := Client(cli, nil)
+	session, _ := Client(cli, nil, testKey)
 	stream, _ := session.OpenStream()
 	buf := make([]byte, 10)
 	var writeErr error
@@ -973,7 +976,7 @@ func BenchmarkAcceptClose(b *testing.B) {
 		b.Fatal(err)
 	}
 	defer stop()
-	session, _ := Client(cli, nil)
+	session, _ := Client(cli, nil, testKey)
 	for i := 0; i < b.N; i++ {
 		if stream, err := session.OpenStream(); err == nil {
 			stream.Close()
@@ -1008,11 +1011,11 @@ func getSmuxStreamPair() (*Stream, *Stream, error) {
 		return nil, nil, err
 	}
 
-	s, err := Server(c2, nil)
+	s, err := Server(c2, nil, testKey)
 	if err != nil {
 		return nil, nil, err
 	}
-	c, err := Client(c1, nil)
+	c, err := Client(c1, nil, testKey)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -1088,3 +1091,269 @@ func bench(b *testing.B, rd io.Reader, wr io.Writer) {
 	}
 	wg.Wait()
 }
+
+func TestStreamMetadata(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan map[string]string)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		session, err := Server(conn, nil, testKey)
+		if err != nil {
+			return
+		}
+		defer session.Close()
+		for {
+			stream, err := session.AcceptStream()
+			if err != nil {
+				return
+			}
+			accepted <- stream.Metadata()
+			go io.Copy(stream, stream)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := Client(conn, nil, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	// Metadata shares the nonce sequence with data frames
+	for i := 0; i < 3; i++ {
+		md := map[string]string{"dst": "example.com:443", "src": "198.51.100.7:51234"}
+		if i == 1 {
+			md = nil
+		}
+		stream, err := session.OpenStreamWithMetadata(md)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := <-accepted
+		if len(got) != len(md) || got["dst"] != md["dst"] || got["src"] != md["src"] {
+			t.Fatalf("metadata %v, want %v", got, md)
+		}
+		checkEcho(t, stream, 65536)
+		stream.Close()
+	}
+
+	large := map[string]string{"dst": string(make([]byte, MaxMetadataSize))}
+	if _, err := session.OpenStreamWithMetadata(large); err != ErrMetadataTooLarge {
+		t.Fatalf("oversized metadata: %v", err)
+	}
+}
+
+func TestGoAway(t *testing.T) {
+	sconn, cconn := net.Pipe()
+	server, err := Server(sconn, nil, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := Client(cconn, nil, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go io.Copy(accepted, accepted)
+
+	if err := server.GoAway(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-client.GoAwayChan():
+	case <-time.After(5 * time.Second):
+		t.Fatal("no GOAWAY received")
+	}
+	if _, err := client.OpenStream(); err != ErrGoAway {
+		t.Fatalf("client opened a stream after GOAWAY: %v", err)
+	}
+	if _, err := server.OpenStream(); err != ErrGoAway {
+		t.Fatalf("server opened a stream after GOAWAY: %v", err)
+	}
+
+	// Running streams carry on
+	checkEcho(t, stream, 65536)
+}
+
+func TestSessionStats(t *testing.T) {
+	pair := func(conf *Config) (client, server *Session) {
+		sconn, cconn := net.Pipe()
+		server, err := Server(sconn, conf, testKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { server.Close() })
+		client, err = Client(cconn, conf, testKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { client.Close() })
+		return client, server
+	}
+
+	// Without keepalives the byte counts of both sides settle
+	conf := DefaultConfig()
+	conf.Version = 2
+	conf.KeepAliveDisabled = true
+	client, server := pair(conf)
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go io.Copy(accepted, accepted)
+	checkEcho(t, stream, 100000)
+
+	st := stream.Stats()
+	if st.BytesOut != 100000 || st.BytesIn != 100000 || st.FramesOut < 4 || st.Buffered != 0 || st.PeerWindow == 0 {
+		t.Errorf("stream stats %+v", st)
+	}
+	if st.Created.IsZero() || st.LastActivity.Before(st.Created) {
+		t.Errorf("stream times %v %v", st.Created, st.LastActivity)
+	}
+
+	// Writes are counted once they return, the peer may have read them
+	// before, and window updates sent after the echo was read may still be
+	// in flight
+	deadline := time.Now().Add(5 * time.Second)
+	as, cs, ss := accepted.Stats(), client.Stats(), server.Stats()
+	for (as.BytesOut != 100000 || cs.BytesOut != ss.BytesIn) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		as, cs, ss = accepted.Stats(), client.Stats(), server.Stats()
+	}
+	if as.BytesIn != 100000 || as.BytesOut != 100000 {
+		t.Errorf("accepted stream stats %+v", as)
+	}
+	if cs.BytesOut < 100000 || cs.BytesOut != ss.BytesIn || cs.FramesOut == 0 || cs.Streams != 1 {
+		t.Errorf("client stats %+v, server stats %+v", cs, ss)
+	}
+	if cs.Buffered != 0 || cs.TokenBucket != conf.MaxReceiveBuffer {
+		t.Errorf("client buffers %+v", cs)
+	}
+
+	// Pings are sent once data came from the peer
+	conf = DefaultConfig()
+	conf.KeepAliveInterval = 20 * time.Millisecond
+	conf.KeepAliveTimeout = time.Second
+	client, server = pair(conf)
+	stream, err = client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err = server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go io.Copy(accepted, accepted)
+	checkEcho(t, stream, 1000)
+	deadline = time.Now().Add(5 * time.Second)
+	for client.Stats().RTT == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no round trip time measured")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// checkEcho writes size random bytes to stream and reads them back
+func checkEcho(t *testing.T, stream *Stream, size int) {
+	sent := make([]byte, size)
+	crand.Read(sent)
+	done := make(chan struct{})
+	go func() {
+		stream.Write(sent)
+		close(done)
+	}()
+
+	received := make([]byte, len(sent))
+	if _, err := io.ReadFull(stream, received); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if !bytes.Equal(sent, received) {
+		t.Fatal("echoed data mismatch")
+	}
+}
+
+func TestSessionStatsOverLimit(t *testing.T) {
+	cs, ss, err := getSmuxStreamPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+	defer ss.Close()
+
+	// A large frame takes the bucket below zero while the streams are not read
+	session := cs.sess
+	atomic.StoreInt32(&session.bucket, -1000)
+	st := session.Stats()
+	if st.TokenBucket != 0 || st.Buffered != session.config.MaxReceiveBuffer {
+		t.Errorf("stats over the limit %+v", st)
+	}
+}
+
+func TestWindowUpdateFrame(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Version = 2
+	sconn, cconn := net.Pipe()
+	server, err := Server(sconn, conf, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := Client(cconn, conf, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An UPD frame carries a payload longer than the encrypted header
+	// alone and must be written as a whole
+	if err := stream.sendWindowUpdate(1234); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadUint32(&accepted.peerConsumed) != 1234 {
+		if time.Now().After(deadline) {
+			t.Fatal("window update not received")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if w := atomic.LoadUint32(&accepted.peerWindow); w != uint32(conf.MaxStreamBuffer) {
+		t.Fatalf("peer window %d, want %d", w, conf.MaxStreamBuffer)
+	}
+}
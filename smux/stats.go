@@ -0,0 +1,139 @@
+package smux
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// SessionStats is a snapshot of the state and traffic of a session
+type SessionStats struct {
+	BytesIn   uint64 // read from the connection, headers included
+	BytesOut  uint64
+	FramesIn  uint64
+	FramesOut uint64
+
+	Created      time.Time
+	LastActivity time.Time // last frame read or written
+
+	Streams     int
+	Buffered    int // received bytes the streams did not read yet, up to MaxReceiveBuffer
+	TokenBucket int // bytes the session may still buffer before it stops reading, 0 when over
+	ShaperQueue int // frames waiting to be sent
+
+	RTT time.Duration // smoothed over the keepalive pings, zero until the first pong
+}
+
+// StreamStats is a snapshot of the state and traffic of a stream
+type StreamStats struct {
+	BytesIn   uint64 // payload only
+	BytesOut  uint64
+	FramesIn  uint64 // data frames
+	FramesOut uint64
+
+	Created      time.Time
+	LastActivity time.Time // last data frame read or written
+
+	Buffered   int    // received bytes not read yet
+	PeerWindow uint32 // bytes the peer accepts before it needs to consume, protocol version 2
+}
+
+// Stats returns the counters and current state of the session
+func (s *Session) Stats() SessionStats {
+	// the bucket goes below zero when a frame arrives while it is nearly
+	// empty, the session is then simply full
+	bucket := max(int(atomic.LoadInt32(&s.bucket)), 0)
+	return SessionStats{
+		BytesIn:      s.stats.BytesIn.Load(),
+		BytesOut:     s.stats.BytesOut.Load(),
+		FramesIn:     s.stats.FramesIn.Load(),
+		FramesOut:    s.stats.FramesOut.Load(),
+		Created:      s.created,
+		LastActivity: time.Unix(0, atomic.LoadInt64(&s.lastActivity)),
+		Streams:      s.NumStreams(),
+		Buffered:     s.config.MaxReceiveBuffer - bucket,
+		TokenBucket:  bucket,
+		ShaperQueue:  int(atomic.LoadInt32(&s.shaperQueue)),
+		RTT:          time.Duration(atomic.LoadInt64(&s.rtt)),
+	}
+}
+
+// Stats returns the counters and current state of the stream
+func (s *Stream) Stats() StreamStats {
+	stats := StreamStats{
+		BytesIn:      atomic.LoadUint64(&s.bytesIn),
+		BytesOut:     atomic.LoadUint64(&s.bytesOut),
+		FramesIn:     atomic.LoadUint64(&s.framesIn),
+		FramesOut:    atomic.LoadUint64(&s.framesOut),
+		Created:      s.created,
+		LastActivity: time.Unix(0, atomic.LoadInt64(&s.lastActivity)),
+	}
+	s.bufferLock.Lock()
+	for _, b := range s.buffers {
+		stats.Buffered += len(b)
+	}
+	s.bufferLock.Unlock()
+	if s.sess.config.Version == 2 {
+		stats.PeerWindow = atomic.LoadUint32(&s.peerWindow)
+	}
+	return stats
+}
+
+// count adds to the counters of the session, and to Config.Counters
+func (s *Session) count(add func(*Counters)) {
+	add(&s.stats)
+	if s.shared != nil {
+		add(s.shared)
+	}
+}
+
+// countIn counts bytes and frames read from the connection
+func (s *Session) countIn(bytes, frames int) {
+	s.count(func(c *Counters) {
+		c.BytesIn.Add(uint64(bytes))
+		c.FramesIn.Add(uint64(frames))
+	})
+	atomic.StoreInt64(&s.lastActivity, time.Now().UnixNano())
+}
+
+// countOut counts bytes and frames written to the connection
+func (s *Session) countOut(bytes, frames int) {
+	s.count(func(c *Counters) {
+		c.BytesOut.Add(uint64(bytes))
+		c.FramesOut.Add(uint64(frames))
+	})
+	atomic.StoreInt64(&s.lastActivity, time.Now().UnixNano())
+}
+
+// ping returns a new ping frame, and notes when it was sent
+func (s *Session) ping() Frame {
+	id := atomic.AddUint32(&s.pingID, 1)
+	atomic.StoreInt64(&s.pingSent, time.Now().UnixNano())
+	return newFrame(byte(s.config.Version), cmdPING, id)
+}
+
+// pong updates the round trip time with the answer to the last ping,
+// smoothed like the TCP SRTT
+func (s *Session) pong(id uint32) {
+	if id != atomic.LoadUint32(&s.pingID) {
+		return
+	}
+	sample := time.Now().UnixNano() - atomic.LoadInt64(&s.pingSent)
+	if rtt := atomic.LoadInt64(&s.rtt); rtt != 0 {
+		sample = (7*rtt + sample) / 8
+	}
+	atomic.StoreInt64(&s.rtt, sample)
+}
+
+// countIn counts a data frame pushed to the stream
+func (s *Stream) countIn(bytes int) {
+	atomic.AddUint64(&s.bytesIn, uint64(bytes))
+	atomic.AddUint64(&s.framesIn, 1)
+	atomic.StoreInt64(&s.lastActivity, time.Now().UnixNano())
+}
+
+// countOut counts a data frame written by the stream
+func (s *Stream) countOut(bytes int) {
+	atomic.AddUint64(&s.bytesOut, uint64(bytes))
+	atomic.AddUint64(&s.framesOut, 1)
+	atomic.StoreInt64(&s.lastActivity, time.Now().UnixNano())
+}
@@ -3,6 +3,7 @@ package smux
 import (
 	"encoding/binary"
 	"io"
+	"log/slog"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -14,6 +15,8 @@ type Stream struct {
 	id   uint32
 	sess *Session
 
+	metadata map[string]string // sent by the opener with SYN
+
 	buffers [][]byte
 	heads   [][]byte // slice heads kept for recycle
 
@@ -44,6 +47,12 @@ type Stream struct {
 	peerConsumed uint32        // num of bytes the peer has consumed
 	peerWindow   uint32        // peer window, initialized to 256KB, updated by peer
 	chUpdate     chan struct{} // notify of remote data consuming and window update
+
+	// statistics, see Stats
+	bytesIn, bytesOut   uint64
+	framesIn, framesOut uint64
+	created             time.Time
+	lastActivity        int64 // unix nanoseconds
 }
 
 // newStream initiates a Stream struct
@@ -57,6 +66,8 @@ func newStream(id uint32, frameSize int, sess *Session) *Stream {
 	s.die = make(chan struct{})
 	s.chFinEvent = make(chan struct{})
 	s.peerWindow = initialPeerWindow // set to initial window size
+	s.created = time.Now()
+	s.lastActivity = s.created.UnixNano()
 	return s
 }
 
@@ -65,6 +76,16 @@ func (s *Stream) ID() uint32 {
 	return s.id
 }
 
+// Logger returns the logger of the session, with the stream ID as a field
+func (s *Stream) Logger() *slog.Logger {
+	return s.sess.log.With("stream", s.id)
+}
+
+// Metadata returns the metadata the stream was opened with
+func (s *Stream) Metadata() map[string]string {
+	return s.metadata
+}
+
 // Read implements net.Conn
 func (s *Stream) Read(b []byte) (n int, err error) {
 	for {
@@ -169,6 +190,10 @@ func (s *Stream) tryReadv2(b []byte) (n int, err error) {
 
 // WriteTo implements io.WriteTo
 func (s *Stream) WriteTo(w io.Writer) (n int64, err error) {
+	if s.sess.config.Version == 2 {
+		return s.writeTov2(w)
+	}
+
 	//defer handlePanic()
 	for {
 		var buf []byte
@@ -329,6 +354,7 @@ func (s *Stream) Write(b []byte) (n int, err error) {
 		if err != nil {
 			return sent, err
 		}
+		s.countOut(n)
 	}
 	// chunkSize := 1300
 	// if chunkSize > len(bts) {
@@ -417,6 +443,7 @@ func (s *Stream) writeV2(b []byte) (n int, err error) {
 				if err != nil {
 					return sent, err
 				}
+				s.countOut(n)
 			}
 		}
 
@@ -452,6 +479,7 @@ func (s *Stream) Close() error {
 	})
 
 	if once {
+		s.Logger().Debug("Stream closed")
 		_, err = s.sess.writeFrame(newFrame(byte(s.sess.config.Version), cmdFIN, s.id))
 		s.sess.streamClosed(s.id)
 		return err
@@ -525,6 +553,7 @@ func (s *Stream) pushBytes(buf []byte) (written int, err error) {
 	s.buffers = append(s.buffers, buf)
 	s.heads = append(s.heads, buf)
 	s.bufferLock.Unlock()
+	s.countIn(len(buf))
 	return
 }
 
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// TLSConfig wraps the transport in TLS 1.3
+type TLSConfig struct {
+	// Server certificate and key files, a self-signed certificate is
+	// generated when they are missing and saved if paths are given
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+
+	// SNI sent by client, defaults to the host of egress
+	ServerName string `json:"sni"`
+
+	// Client verifies the server certificate against the hex SHA256
+	// fingerprint of its DER encoding, and/or a PEM CA bundle
+	Fingerprint string `json:"fingerprint"`
+	CA          string `json:"ca"`
+
+	ALPN []string `json:"alpn"`
+}
+
+const tlsHandshakeTimeout = 30 * time.Second
+
+var (
+	ErrFingerprintMismatch = errors.New("tls certificate fingerprint mismatch")
+)
+
+// serverConfig loads or generates the server certificate
+func (t *TLSConfig) serverConfig(log *slog.Logger) (*tls.Config, error) {
+	cert, err := t.loadCertificate(log)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("Tls certificate loaded", "fingerprint", fingerprint(cert.Certificate[0]))
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS13,
+		NextProtos:   t.ALPN,
+	}, nil
+}
+
+// clientConfig returns the client config, the server certificate is verified
+// by fingerprint when pinned, and by the CA bundle or system roots otherwise
+func (t *TLSConfig) clientConfig() (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName: t.ServerName,
+		MinVersion: tls.VersionTLS13,
+		NextProtos: t.ALPN,
+	}
+
+	if t.CA != "" {
+		pem, err := os.ReadFile(t.CA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", t.CA)
+		}
+	}
+
+	if t.Fingerprint != "" {
+		pin, err := parseFingerprint(t.Fingerprint)
+		if err != nil {
+			return nil, err
+		}
+		// Pinned certificate replaces chain verification unless a CA is given
+		cfg.InsecureSkipVerify = t.CA == ""
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return ErrFingerprintMismatch
+			}
+			sum := sha256.Sum256(cs.PeerCertificates[0].Raw)
+			if !bytes.Equal(sum[:], pin) {
+				return ErrFingerprintMismatch
+			}
+			return nil
+		}
+	}
+	return cfg, nil
+}
+
+// clientConfigFor returns a copy of cfg with SNI defaulting to the host of addr
+func clientConfigFor(cfg *tls.Config, addr string) *tls.Config {
+	cfg = cfg.Clone()
+	if cfg.ServerName == "" {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			cfg.ServerName = host
+		}
+	}
+	return cfg
+}
+
+// loadCertificate generates a certificate only when neither file exists, a
+// missing half of a pair is an error rather than overwritten
+func (t *TLSConfig) loadCertificate(log *slog.Logger) (tls.Certificate, error) {
+	if t.Cert != "" && t.Key != "" {
+		cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err == nil || !errors.Is(err, os.ErrNotExist) || exists(t.Cert) || exists(t.Key) {
+			return cert, err
+		}
+	}
+
+	certPEM, keyPEM, err := selfSignedCertificate()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if t.Cert != "" && t.Key != "" {
+		if err := os.WriteFile(t.Cert, certPEM, 0644); err != nil {
+			return tls.Certificate{}, err
+		}
+		if err := os.WriteFile(t.Key, keyPEM, 0600); err != nil {
+			return tls.Certificate{}, err
+		}
+		log.Info("Generated self-signed certificate", "path", t.Cert)
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return !errors.Is(err, os.ErrNotExist)
+}
+
+func selfSignedCertificate() (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "toriix"},
+		DNSNames:     []string{"toriix"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// parseFingerprint decodes a hex SHA256 fingerprint, colons are ignored
+func parseFingerprint(s string) ([]byte, error) {
+	pin, err := hex.DecodeString(strings.ReplaceAll(s, ":", ""))
+	if err != nil || len(pin) != sha256.Size {
+		return nil, fmt.Errorf("invalid tls fingerprint %q", s)
+	}
+	return pin, nil
+}
+
+func fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// tlsConfigs builds the config for the side of the tunnel c runs on
+func tlsConfigs(c *Config, t *TLSConfig, log *slog.Logger) (client, server *tls.Config, err error) {
+	if c.Mode == "server" {
+		server, err = t.serverConfig(log)
+	} else {
+		client, err = t.clientConfig()
+	}
+	return
+}
+
+// tlsTransport carries sessions over tcp wrapped in TLS
+type tlsTransport struct {
+	tcpTransport
+	client  *tls.Config
+	server  *tls.Config
+	timeout time.Duration // of the client handshake
+}
+
+func init() {
+	registerTransport("tls", func(c *Config, log *slog.Logger) (Transport, error) {
+		conf := c.TLS
+		if conf == nil {
+			conf = &TLSConfig{}
+		}
+		client, server, err := tlsConfigs(c, conf, log)
+		if err != nil {
+			return nil, err
+		}
+		tcp, err := newTCPTransport(c, log)
+		if err != nil {
+			return nil, err
+		}
+		return &tlsTransport{
+			tcpTransport: *tcp.(*tcpTransport),
+			client:       client,
+			server:       server,
+			timeout:      tlsHandshakeTimeout,
+		}, nil
+	})
+}
+
+func (t *tlsTransport) Dial(addr string) (net.Conn, error) {
+	conn, err := t.tcpTransport.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// a peer which never answers must not hold up the client
+	conn.SetDeadline(time.Now().Add(t.timeout))
+	tc := tls.Client(conn, clientConfigFor(t.client, addr))
+	if err := tc.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tc, nil
+}
+
+func (t *tlsTransport) Listen(addr string) (net.Listener, error) {
+	ln, err := t.tcpTransport.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(ln, t.server), nil
+}
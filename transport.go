@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"golang.org/x/net/proxy"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+)
+
+// Transport carries smux sessions between client and server
+type Transport interface {
+	// Dial connects to the server listening on addr
+	Dial(addr string) (net.Conn, error)
+
+	// Listen accepts client connections on addr
+	Listen(addr string) (net.Listener, error)
+}
+
+// transports holds the constructors of registered transports by name
+var transports = make(map[string]func(c *Config, log *slog.Logger) (Transport, error))
+
+// registerTransport makes a transport selectable by the transport config key
+func registerTransport(name string, f func(c *Config, log *slog.Logger) (Transport, error)) {
+	if _, ok := transports[name]; ok {
+		panic("transport " + name + " registered twice")
+	}
+	transports[name] = f
+}
+
+// newTransport returns the transport selected by c, tcp by default, logging
+// to log
+func newTransport(c *Config, log *slog.Logger) (Transport, error) {
+	name := c.Transport
+	if name == "" {
+		name = "tcp"
+	}
+	f, ok := transports[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown transport %q, available: %v", name, transportNames())
+	}
+	t, err := f(c, log)
+	if err != nil {
+		return nil, err
+	}
+
+	// Stripe the session over several connections of the transport, and
+	// keep it across reconnections when resumption is enabled
+	if c.Paths > 1 || c.Resume > 0 {
+		t = &mpTransport{inner: t, paths: max(c.Paths, 1), grace: c.resumeGrace(), psk: func() string { return c.PSK }, log: log}
+	}
+	return t, nil
+}
+
+func transportNames() []string {
+	var names []string
+	for name := range transports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func initTransportListener(t Transport, addr string) (net.Listener, error) {
+	listener, err := t.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Listener started", "addr", addr)
+	return listener, nil
+}
+
+// tcpTransport carries sessions over plain tcp or unix: connections
+type tcpTransport struct {
+	mode       os.FileMode
+	dialer     proxy.Dialer
+	proxyProto bool // accepted connections start with a PROXY protocol header
+}
+
+func init() {
+	registerTransport("tcp", newTCPTransport)
+}
+
+func newTCPTransport(c *Config, log *slog.Logger) (Transport, error) {
+	dialer, err := newDialer(c.Upstream, proxy.Direct)
+	if err != nil {
+		return nil, err
+	}
+	return &tcpTransport{mode: c.socketMode(), dialer: dialer, proxyProto: c.AcceptProxyProtocol}, nil
+}
+
+func (t *tcpTransport) Dial(addr string) (net.Conn, error) {
+	return dialVia(t.dialer, addr)
+}
+
+func (t *tcpTransport) Listen(addr string) (net.Listener, error) {
+	ln, err := listen(addr, t.mode)
+	if err != nil {
+		return nil, err
+	}
+	if t.proxyProto {
+		ln = &proxyProtoListener{ln}
+	}
+	return ln, nil
+}
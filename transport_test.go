@@ -0,0 +1,579 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"github.com/ktcunreal/toriix/smux"
+	"github.com/xtaci/kcp-go/v5"
+	"io"
+	"log/slog"
+	mrand "math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testKey = "some-long-password-for-tests"
+
+// serveEcho echoes the first stream of the first session accepted on l
+func serveEcho(l net.Listener) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	session, err := smux.Server(conn, nil, testKey)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+	stream, err := session.AcceptStream()
+	if err != nil {
+		return
+	}
+	defer stream.Close()
+	io.Copy(stream, stream)
+}
+
+func openEchoStream(t *testing.T, conn net.Conn) (*smux.Session, *smux.Stream) {
+	session, err := smux.Client(conn, nil, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := session.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session, stream
+}
+
+// checkEcho writes size random bytes to stream and expects them back
+func checkEcho(t *testing.T, stream *smux.Stream, size int) {
+	sent := make([]byte, size)
+	rand.Read(sent)
+	done := make(chan struct{})
+	go func() {
+		stream.Write(sent)
+		close(done)
+	}()
+
+	received := make([]byte, len(sent))
+	if _, err := io.ReadFull(stream, received); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if !bytes.Equal(sent, received) {
+		t.Fatal("echoed data mismatch")
+	}
+}
+
+// testTransport echoes data over a smux session carried by a connection
+// from dial to one accepted on l
+func testTransport(t *testing.T, dial func() (net.Conn, error), l net.Listener) {
+	go serveEcho(l)
+
+	conn, err := dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, stream := openEchoStream(t, conn)
+	defer session.Close()
+	defer stream.Close()
+	checkEcho(t, stream, 1<<20)
+}
+
+func TestTCPTransport(t *testing.T) {
+	tr, err := newTransport(&Config{}, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tr.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	testTransport(t, func() (net.Conn, error) {
+		return tr.Dial(l.Addr().String())
+	}, l)
+}
+
+func TestWSTransport(t *testing.T) {
+	c := &Config{Transport: "ws", WSPath: "/tunnel", WSHost: "cdn.example.com"}
+	tr, err := newTransport(c, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var host string
+	l := newWSListener(nil, c.WSPath)
+	defer l.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+		l.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	testTransport(t, func() (net.Conn, error) {
+		return tr.Dial(srv.Listener.Addr().String())
+	}, l)
+	if host != c.WSHost {
+		t.Fatalf("upgrade request host %q, want %q", host, c.WSHost)
+	}
+
+	resp, err := http.Get(srv.URL + "/other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("status %d on unknown path, want 404", resp.StatusCode)
+	}
+}
+
+func TestTLSTransport(t *testing.T) {
+	dir := t.TempDir()
+	sc := &Config{Mode: "server", Transport: "tls", TLS: &TLSConfig{
+		Cert: filepath.Join(dir, "cert.pem"),
+		Key:  filepath.Join(dir, "key.pem"),
+		ALPN: []string{"h2"},
+	}}
+	st, err := newTransport(sc, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := st.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	cert, err := tls.LoadX509KeyPair(sc.TLS.Cert, sc.TLS.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := &Config{Mode: "client", Transport: "tls", TLS: &TLSConfig{
+		ServerName:  "toriix",
+		Fingerprint: fingerprint(cert.Certificate[0]),
+		ALPN:        []string{"h2"},
+	}}
+	ct, err := newTransport(cc, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testTransport(t, func() (net.Conn, error) {
+		return ct.Dial(l.Addr().String())
+	}, l)
+
+	// Self-signed certificate without pin must be rejected
+	ut, err := newTransport(&Config{Mode: "client", Transport: "tls"}, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	if conn, err := ut.Dial(l.Addr().String()); err == nil {
+		conn.Close()
+		t.Fatal("unverified certificate accepted")
+	}
+
+	// A peer accepting tcp without answering the handshake times out
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	ct.(*tlsTransport).timeout = 100 * time.Millisecond
+	if conn, err := ct.Dial(silent.Addr().String()); err == nil {
+		conn.Close()
+		t.Fatal("handshake with a silent peer succeeded")
+	}
+
+	// A lone certificate is not overwritten when its key is missing
+	before, _ := os.ReadFile(sc.TLS.Cert)
+	os.Remove(sc.TLS.Key)
+	if _, err := sc.TLS.loadCertificate(slog.Default()); err == nil {
+		t.Error("certificate without key loaded")
+	}
+	if after, _ := os.ReadFile(sc.TLS.Cert); !bytes.Equal(before, after) {
+		t.Error("certificate overwritten")
+	}
+}
+
+// lossyPacketConn drops a share of outgoing packets
+type lossyPacketConn struct {
+	net.PacketConn
+	loss float64
+}
+
+func (c *lossyPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if mrand.Float64() < c.loss {
+		return len(b), nil
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func TestKCPTransport(t *testing.T) {
+	tr, err := newTransport(&Config{Transport: "kcp"}, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tr.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	testTransport(t, func() (net.Conn, error) {
+		return tr.Dial(l.Addr().String())
+	}, l)
+}
+
+func TestKCPTransportLoss(t *testing.T) {
+	var conf KCPConfig
+	if err := json.Unmarshal([]byte(`{"nodelay": 1, "interval": 10}`), &conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.ParityShards != DefaultKCPConfig().ParityShards {
+		t.Fatalf("parity shards %d, want default", conf.ParityShards)
+	}
+	tr, err := newTransport(&Config{Transport: "kcp", KCP: &conf}, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	kt := tr.(*kcpTransport)
+
+	spc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spc.Close()
+	cpc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cpc.Close()
+
+	l, err := kcpListenPacket(kt, &lossyPacketConn{PacketConn: spc, loss: 0.05})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	testTransport(t, func() (net.Conn, error) {
+		return kcpDialPacket(kt, spc.LocalAddr(), &lossyPacketConn{PacketConn: cpc, loss: 0.05})
+	}, l)
+}
+
+// kcpDialPacket connects to addr over pc like kcpTransport.Dial, pc is left
+// open when the session closes
+func kcpDialPacket(t *kcpTransport, addr net.Addr, pc net.PacketConn) (net.Conn, error) {
+	sess, err := kcp.NewConn2(addr, nil, t.conf.DataShards, t.conf.ParityShards, pc)
+	if err != nil {
+		return nil, err
+	}
+	t.tune(sess)
+	return sess, nil
+}
+
+// kcpListenPacket accepts sessions from pc like kcpTransport.Listen, pc is
+// left open when the listener closes
+func kcpListenPacket(t *kcpTransport, pc net.PacketConn) (net.Listener, error) {
+	ln, err := kcp.ServeConn(nil, t.conf.DataShards, t.conf.ParityShards, pc)
+	if err != nil {
+		return nil, err
+	}
+	return &kcpListener{Listener: ln, t: t}, nil
+}
+
+// recordingTransport keeps the connections dialed through it
+type recordingTransport struct {
+	Transport
+	conns []net.Conn
+	lock  sync.Mutex
+}
+
+func (t *recordingTransport) Dial(addr string) (net.Conn, error) {
+	conn, err := t.Transport.Dial(addr)
+	if err == nil {
+		t.lock.Lock()
+		t.conns = append(t.conns, conn)
+		t.lock.Unlock()
+	}
+	return conn, err
+}
+
+func (t *recordingTransport) numConns() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.conns)
+}
+
+func TestMultipathTransport(t *testing.T) {
+	tr, err := newTransport(&Config{Paths: 3}, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tr.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	testTransport(t, func() (net.Conn, error) {
+		return tr.Dial(l.Addr().String())
+	}, l)
+}
+
+func TestMultipathPathLoss(t *testing.T) {
+	inner, err := newTransport(&Config{}, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := &recordingTransport{Transport: inner}
+	tr := &mpTransport{inner: rt, paths: 3, psk: func() string { return testKey }, log: slog.Default()}
+	l, err := tr.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveEcho(l)
+
+	conn, err := tr.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rt.numConns() < 3 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	session, stream := openEchoStream(t, conn)
+	defer session.Close()
+	defer stream.Close()
+
+	checkEcho(t, stream, 1<<20)
+	rt.conns[1].Close()
+	checkEcho(t, stream, 1<<20)
+	rt.conns[0].Close()
+	checkEcho(t, stream, 1<<20)
+}
+
+func TestResume(t *testing.T) {
+	inner, err := newTransport(&Config{}, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := &recordingTransport{Transport: inner}
+	tr := &mpTransport{inner: rt, paths: 1, grace: 10 * time.Second, psk: func() string { return testKey }, log: slog.Default()}
+	l, err := tr.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveEcho(l)
+
+	conn, err := tr.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, stream := openEchoStream(t, conn)
+	defer session.Close()
+	defer stream.Close()
+
+	checkEcho(t, stream, 1<<20)
+	rt.conns[0].Close()
+	checkEcho(t, stream, 1<<20)
+	if rt.numConns() != 2 {
+		t.Fatalf("%d connections dialed, want 2", rt.numConns())
+	}
+}
+
+func TestMultipathAuth(t *testing.T) {
+	inner, err := newTransport(&Config{}, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &mpTransport{inner: inner, paths: 1, psk: func() string { return testKey }, log: slog.Default()}
+	l, err := st.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ct := &mpTransport{inner: inner, paths: 1, psk: func() string { return "wrong" }, log: slog.Default()}
+	if conn, err := ct.Dial(l.Addr().String()); err == nil {
+		conn.Close()
+		t.Fatal("path with wrong key accepted")
+	}
+
+	// Chunks beyond the window of the sender are refused
+	c := &mpConn{pending: make(map[uint64][]byte), chReadable: make(chan struct{}, 1)}
+	if err := c.receive(mpWindowChunks-1, []byte{0}); err != nil {
+		t.Errorf("chunk in window: %v", err)
+	}
+	if err := c.receive(mpWindowChunks, []byte{0}); err != ErrInvalidFrame {
+		t.Errorf("chunk beyond window: %v", err)
+	}
+
+	// Nothing beyond what was sent is acknowledged, and a path joins once
+	if err := c.acknowledge(1); err != ErrInvalidFrame {
+		t.Errorf("ack beyond sent: %v", err)
+	}
+	nonce := make([]byte, mpNonceSize)
+	if !c.joined(nonce) || c.joined(nonce) {
+		t.Error("replayed path joined")
+	}
+}
+
+// serveConnectProxy serves http CONNECT requests on l, requiring auth
+func serveConnectProxy(l net.Listener, auth string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			br := bufio.NewReader(conn)
+			req, err := http.ReadRequest(br)
+			if err != nil {
+				return
+			}
+			if req.Method != http.MethodConnect || req.Header.Get("Proxy-Authorization") != auth {
+				io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+				return
+			}
+			dst, err := net.Dial("tcp", req.Host)
+			if err != nil {
+				io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+				return
+			}
+			defer dst.Close()
+			io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+			go io.Copy(dst, br)
+			io.Copy(conn, dst)
+		}()
+	}
+}
+
+func TestUpstreamHTTPProxy(t *testing.T) {
+	pl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pl.Close()
+	go serveConnectProxy(pl, "Basic dXNlcjpzZWNyZXQ=")
+
+	st, err := newTransport(&Config{}, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := st.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ct, err := newTransport(&Config{Upstream: "http://user:secret@" + pl.Addr().String()}, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testTransport(t, func() (net.Conn, error) {
+		return ct.Dial(l.Addr().String())
+	}, l)
+
+	ut, err := newTransport(&Config{Upstream: "http://user:wrong@" + pl.Addr().String()}, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := ut.Dial(l.Addr().String()); err == nil {
+		conn.Close()
+		t.Fatal("dial succeeded with wrong proxy credentials")
+	}
+}
+
+func TestDialConfig(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	d := &DialConfig{Bind: "127.0.0.1", Timeout: 5, KeepAlive: -1}
+	if err := d.validate(); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := d.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if ip := conn.LocalAddr().(*net.TCPAddr).IP; !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("dialed from %v, want 127.0.0.1", ip)
+	}
+
+	pl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pl.Close()
+	go serveConnectProxy(pl, "")
+	d.Upstream = "http://" + pl.Addr().String()
+	conn, err = d.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if conn.RemoteAddr().String() != pl.Addr().String() {
+		t.Fatalf("dialed %v, want proxy %v", conn.RemoteAddr(), pl.Addr())
+	}
+
+	for _, d := range []*DialConfig{{Bind: "localhost"}, {Interface: "no-such-if0"}, {Upstream: "ftp://proxy"}} {
+		if d.validate() == nil {
+			t.Fatalf("invalid config %+v accepted", d)
+		}
+	}
+}
+
+func TestNewTransport(t *testing.T) {
+	if _, err := newTransport(&Config{Transport: "carrier-pigeon"}, slog.Default()); err == nil {
+		t.Error("unknown transport accepted")
+	}
+	if _, ok := transports["tcp"]; !ok {
+		t.Fatal("tcp transport not registered")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("registering tcp twice did not panic")
+		}
+	}()
+	registerTransport("tcp", nil)
+}
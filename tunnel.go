@@ -0,0 +1,682 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ktcunreal/toriix/smux"
+	"io"
+	"log/slog"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tunnel runs the server or client side described by a config. Its config
+// is swapped on reload, and read anew by each session and stream. Stopping
+// a tunnel closes its listeners and sends GOAWAY on its sessions, which
+// keep serving their running streams and are closed once idle. A paused
+// tunnel refuses new connections and streams.
+type tunnel struct {
+	name    string
+	conf    atomic.Pointer[Config]
+	closers []io.Closer
+	conns   chan net.Conn // accepted on client ingress
+	stop    chan struct{}
+	once    sync.Once
+	level   slog.LevelVar
+	log     *slog.Logger
+	metrics *tunnelMetrics
+	paused  atomic.Bool
+
+	sessions map[*smux.Session]chan struct{} // closed to send GOAWAY
+	lock     sync.Mutex
+}
+
+func tunnelName(c *Config) string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return "default"
+}
+
+// startTunnel opens the listeners of c and serves them in the background
+func startTunnel(c *Config) (*tunnel, error) {
+	t := &tunnel{name: tunnelName(c), stop: make(chan struct{}), sessions: make(map[*smux.Session]chan struct{})}
+	t.log = newLogger(&t.level).With("tunnel", t.name)
+	t.metrics = metricsFor(t.name)
+	t.setConfig(c)
+
+	transport, err := newTransport(c, t.log)
+	if err != nil {
+		return nil, err
+	}
+	if mt, ok := transport.(*mpTransport); ok {
+		// paths are keyed with the psk of the running config
+		mt.psk = func() string { return t.config().PSK }
+	}
+	switch c.Mode {
+	case "server":
+		err = t.startServer(transport)
+	case "client":
+		err = t.startClient(transport)
+	default:
+		err = fmt.Errorf("unknown mode %q", c.Mode)
+	}
+	if err != nil {
+		t.close()
+		return nil, err
+	}
+	t.log.Info("Tunnel started")
+	return t, nil
+}
+
+func (t *tunnel) config() *Config {
+	return t.conf.Load()
+}
+
+// setConfig swaps the config of the tunnel, and applies its log level
+func (t *tunnel) setConfig(c *Config) {
+	t.conf.Store(c)
+	t.level.Set(c.logLevel())
+}
+
+// smuxConfig returns the session config, logging to the tunnel logger and
+// counting to its metrics
+func (t *tunnel) smuxConfig(c *Config) *smux.Config {
+	conf := c.smuxConfig()
+	conf.Logger = t.log
+	conf.Counters = &t.metrics.Counters
+	return conf
+}
+
+func (t *tunnel) stopped() bool {
+	select {
+	case <-t.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// close stops the tunnel from accepting connections
+func (t *tunnel) close() {
+	t.once.Do(func() {
+		close(t.stop)
+		for _, c := range t.closers {
+			c.Close()
+		}
+	})
+}
+
+// addSession tracks session until it closes, the returned channel is
+// closed once it should go away: its binds are released and no streams are
+// opened on it anymore
+func (t *tunnel) addSession(session *smux.Session) <-chan struct{} {
+	goAway := make(chan struct{})
+	t.lock.Lock()
+	t.sessions[session] = goAway
+	t.lock.Unlock()
+	go t.closeWhenIdle(session, goAway)
+	return goAway
+}
+
+// goAway sends GOAWAY on session, which is closed once idle. A client
+// reconnects for new streams.
+func (t *tunnel) goAway(session *smux.Session) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if goAway, ok := t.sessions[session]; ok {
+		select {
+		case <-goAway:
+		default:
+			close(goAway)
+		}
+	}
+}
+
+// session returns the open session of the tunnel with id
+func (t *tunnel) session(id uint64) *smux.Session {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for session := range t.sessions {
+		if session.ID() == id {
+			return session
+		}
+	}
+	return nil
+}
+
+// sessionList returns the open sessions of the tunnel, oldest first
+func (t *tunnel) sessionList() []*smux.Session {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	sessions := make([]*smux.Session, 0, len(t.sessions))
+	for session := range t.sessions {
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ID() < sessions[j].ID() })
+	return sessions
+}
+
+func (t *tunnel) numSessions() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.sessions)
+}
+
+// closeWhenIdle closes session once it has no stream left, after the tunnel
+// stopped or either side sent GOAWAY
+func (t *tunnel) closeWhenIdle(session *smux.Session, goAway <-chan struct{}) {
+	defer func() {
+		t.lock.Lock()
+		delete(t.sessions, session)
+		t.lock.Unlock()
+	}()
+
+	select {
+	case <-session.CloseChan():
+		return
+	case <-session.GoAwayChan():
+	case <-t.stop:
+		t.goAway(session)
+		session.GoAway()
+	case <-goAway:
+		session.GoAway()
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for session.NumStreams() > 0 {
+		select {
+		case <-session.CloseChan():
+			return
+		case <-ticker.C:
+		}
+	}
+	session.Close()
+}
+
+// drain waits until the sessions of the stopped tunnel closed, those left
+// at deadline are closed
+func (t *tunnel) drain(deadline time.Time) {
+	for t.numSessions() > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for session := range t.sessions {
+		session.Close()
+	}
+}
+
+func (t *tunnel) startServer(transport Transport) error {
+	c := t.config()
+	listener, err := initTransportListener(transport, c.Ingress)
+	if err != nil {
+		return err
+	}
+	t.closers = append(t.closers, listener)
+
+	// Expose reverse tunnel through public listener
+	var pool *sessionPool
+	if c.Reverse != "" {
+		public, err := initListener(c.Reverse, c.socketMode())
+		if err != nil {
+			return err
+		}
+		t.closers = append(t.closers, public)
+		if c.AcceptProxyProtocol {
+			public = &proxyProtoListener{public}
+		}
+		pool = &sessionPool{}
+		go t.serveReverse(public, pool)
+	}
+
+	go t.serveServer(listener, pool)
+	return nil
+}
+
+// serveServer accepts client connections until the tunnel stops
+func (t *tunnel) serveServer(listener net.Listener, pool *sessionPool) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if t.stopped() {
+				return
+			}
+			t.log.Warn("Failed to accept connection", "err", err)
+			continue
+		}
+		if t.paused.Load() {
+			conn.Close()
+			continue
+		}
+		go t.serveSession(conn, pool)
+	}
+}
+
+// serveSession handles the streams opened by a client until its session ends
+func (t *tunnel) serveSession(conn net.Conn, pool *sessionPool) {
+	defer conn.Close()
+	c := t.config()
+	session, err := smux.Server(conn, t.smuxConfig(c), c.PSK)
+	if err != nil {
+		t.log.Error("Failed to create smux session", "err", err)
+		return
+	}
+	defer session.Close()
+	goAway := t.addSession(session)
+
+	if pool != nil {
+		pool.add(session)
+		defer pool.remove(session)
+		// Reverse streams go to the other sessions once it goes away
+		go func() {
+			select {
+			case <-goAway:
+				pool.remove(session)
+			case <-session.CloseChan():
+			}
+		}()
+	}
+
+	for {
+		// Accept smux stream
+		src, err := session.AcceptStream()
+		if err != nil {
+			session.Logger().Info("Session ended", "err", err)
+			if err == smux.ErrInvalidProtocol || err == smux.ErrDecryptFailed || err == smux.ErrInvalidHeader {
+				io.Copy(io.Discard, conn)
+			}
+			return
+		}
+
+		if t.paused.Load() {
+			src.Close()
+			continue
+		}
+
+		// Establish Remote TCP connection
+		c := t.config()
+		go handleStream(session, src, c.Egress, c, goAway)
+	}
+}
+
+func (t *tunnel) startClient(transport Transport) error {
+	c := t.config()
+	var listener net.Listener
+	var pc net.PacketConn
+	var err error
+	switch {
+	case c.Reverse != "", c.Ingress == "":
+		// Streams are opened by server, no ingress needed
+	case c.Network == "udp":
+		if pc, err = initPacketListener(c.Ingress); err != nil {
+			return err
+		}
+		t.closers = append(t.closers, pc)
+	default:
+		if listener, err = initListener(c.Ingress, c.socketMode()); err != nil {
+			return err
+		}
+		t.closers = append(t.closers, listener)
+		if c.AcceptProxyProtocol {
+			listener = &proxyProtoListener{listener}
+		}
+		t.conns = make(chan net.Conn)
+		go t.acceptIngress(listener)
+	}
+
+	go t.runClient(transport, pc)
+	return nil
+}
+
+// acceptIngress hands the connections accepted on the ingress listener to
+// the current session, until the tunnel stops
+func (t *tunnel) acceptIngress(listener net.Listener) {
+	for {
+		src, err := listener.Accept()
+		if err != nil {
+			if t.stopped() {
+				return
+			}
+			t.log.Warn("Failed to accept connection", "err", err)
+			continue
+		}
+		if t.paused.Load() {
+			src.Close()
+			continue
+		}
+		select {
+		case t.conns <- src:
+		case <-t.stop:
+			src.Close()
+			return
+		}
+	}
+}
+
+// runClient keeps a session to the server until the tunnel stops
+func (t *tunnel) runClient(transport Transport, pc net.PacketConn) {
+	for !t.stopped() {
+		c := t.config()
+		conn, err := transport.Dial(c.Egress)
+		if err != nil {
+			t.log.Warn("Server unreachable", "err", err)
+			select {
+			case <-time.After(time.Second * 5):
+			case <-t.stop:
+			}
+			continue
+		}
+
+		session, err := smux.Client(conn, t.smuxConfig(c), c.PSK)
+		if err != nil {
+			t.log.Error("Failed to create smux session", "err", err)
+			conn.Close()
+			continue
+		}
+		goAway := t.addSession(session)
+		t.serveClient(session, goAway, c, pc)
+	}
+}
+
+// serveClient forwards the ingress of the tunnel over session, until the
+// session ends or goes away, or the tunnel stops
+func (t *tunnel) serveClient(session *smux.Session, goAway <-chan struct{}, c *Config, pc net.PacketConn) {
+	go func() {
+		if err := sayHello(session, c.smuxConfig()); err != nil {
+			session.Logger().Warn("Session hello failed", "err", err)
+		}
+	}()
+
+	// Register remote binds and serve streams opened by server
+	for _, b := range c.Binds {
+		go func(b Bind) {
+			if err := requestBind(session, b, goAway); err != nil {
+				session.Logger().Warn("Failed to bind", "remote", b.Remote, "err", err)
+			}
+		}(b)
+	}
+	if c.Reverse != "" || len(c.Binds) > 0 {
+		go t.serveStreams(session, goAway)
+	}
+
+	switch {
+	case pc != nil:
+		if err := serveUDP(pc, session, c.udpTimeout(), goAway, &t.paused); err == smux.ErrGoAway {
+			session.Logger().Info("Server is going away, reconnecting")
+		} else {
+			if !t.stopped() {
+				session.Logger().Warn("Udp forwarding stopped", "err", err)
+			}
+			session.Close()
+		}
+	case t.conns != nil:
+		t.serveIngress(session, goAway)
+	default:
+		select {
+		case <-session.CloseChan():
+		case <-session.GoAwayChan():
+			session.Logger().Info("Server is going away, reconnecting")
+		case <-goAway:
+			session.Logger().Info("Reconnecting")
+		case <-t.stop:
+		}
+	}
+}
+
+// serveIngress opens a stream over session for each connection accepted
+// on the ingress listener
+func (t *tunnel) serveIngress(session *smux.Session, goAway <-chan struct{}) {
+	for {
+		select {
+		case src := <-t.conns:
+			go t.forward(src, session)
+		case <-session.GoAwayChan():
+			session.Logger().Info("Server is going away, reconnecting")
+			return
+		case <-session.CloseChan():
+			session.Logger().Info("Session is closed")
+			return
+		case <-goAway:
+			session.Logger().Info("Reconnecting")
+			return
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// forward carries an ingress connection over a stream of session
+func (t *tunnel) forward(src net.Conn, session *smux.Session) {
+	defer src.Close()
+	if t.config().Proxy {
+		if err := serveHTTPProxy(src, session); err != nil {
+			session.Logger().Warn("Proxy request failed", "src", src.RemoteAddr().String(), "err", err)
+		}
+		return
+	}
+
+	stream, err := openStream(session, sourceHeader(streamHeader{}, src))
+	if err != nil {
+		session.Logger().Warn("Failed to open stream", "src", src.RemoteAddr().String(), "err", err)
+		if err != smux.ErrGoAway {
+			session.Close()
+		}
+		return
+	}
+	defer stream.Close()
+	log := stream.Logger().With("src", src.RemoteAddr().String())
+	log.Debug("Forwarding")
+	err1, err2 := smux.Pipe(src, stream, 0)
+	if err1 != nil && err1 != io.EOF {
+		log.Debug("Forwarding stopped", "err", err1)
+	}
+	if err2 != nil && err2 != io.EOF {
+		log.Debug("Forwarding stopped", "err", err2)
+	}
+}
+
+// serveStreams handles the streams opened by server until the session ends
+func (t *tunnel) serveStreams(session *smux.Session, goAway <-chan struct{}) {
+	defer session.Close()
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			session.Logger().Debug("Stopped accepting streams", "err", err)
+			return
+		}
+		if t.paused.Load() {
+			stream.Close()
+			continue
+		}
+		c := t.config()
+		go handleStream(session, stream, c.Reverse, c, goAway)
+	}
+}
+
+// listenerSettings clears the settings read anew for each session or
+// stream, a tunnel is restarted on reload when the rest changes
+func (c Config) listenerSettings() Config {
+	if c.Mode == "server" {
+		// Clients dial egress with a transport set up for it
+		c.Egress = ""
+	}
+	c.PSK, c.KeyFile = "", ""
+	c.Proxy = false
+	c.UDPTimeout = 0
+	c.AllowBinds = nil
+	c.Dial, c.Smux = nil, nil
+	c.ProxyProtocol = ""
+	c.Admin, c.Metrics, c.DrainTimeout = "", "", 0
+	c.LogLevel, c.LogFormat = "", ""
+	return c
+}
+
+// tunnelSet holds the running tunnels by name, and the stopped ones whose
+// sessions are still draining
+type tunnelSet struct {
+	args    []string
+	tunnels map[string]*tunnel
+	retired []*tunnel
+	drain   time.Duration
+	lock    sync.Mutex
+}
+
+func newTunnelSet(args []string) *tunnelSet {
+	return &tunnelSet{args: args, tunnels: make(map[string]*tunnel)}
+}
+
+// reload reads the config from the command line arguments, environment and
+// config file again, and applies it. The running tunnels are left as they
+// are if it is not valid.
+func (s *tunnelSet) reload() error {
+	conf, err := readFromConfig(s.args)
+	if err != nil {
+		return err
+	}
+	if err := conf.Validate(); err != nil {
+		return err
+	}
+	return s.apply(conf)
+}
+
+// apply starts the tunnels of conf which are not running and stops those
+// it no longer has. Running tunnels take the new settings in place, or are
+// restarted when their listeners or transport change.
+func (s *tunnelSet) apply(conf *Config) error {
+	configs, err := conf.tunnelConfigs()
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.drain = conf.drainTimeout()
+	logLevel.Set(conf.logLevel())
+
+	retired := s.retired[:0]
+	for _, t := range s.retired {
+		if t.numSessions() > 0 {
+			retired = append(retired, t)
+		}
+	}
+	s.retired = retired
+
+	wanted := make(map[string]bool)
+	for _, c := range configs {
+		wanted[tunnelName(c)] = true
+	}
+	for name, t := range s.tunnels {
+		if !wanted[name] {
+			s.retire(t)
+			t.log.Info("Tunnel removed")
+		}
+	}
+
+	var errs []error
+	for _, c := range configs {
+		name := tunnelName(c)
+		var old *Config
+		if t, ok := s.tunnels[name]; ok {
+			old = t.config()
+			if reflect.DeepEqual(old, c) {
+				continue
+			}
+			if reflect.DeepEqual(old.listenerSettings(), c.listenerSettings()) {
+				t.setConfig(c)
+				t.log.Info("Tunnel updated")
+				continue
+			}
+			// the listeners are released first, they may be kept by c
+			s.retire(t)
+			t.log.Info("Tunnel restarting")
+		}
+
+		t, err := startTunnel(c)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("tunnel %s: %v", name, err))
+			if old == nil {
+				continue
+			}
+			// keep serving with the config which was running
+			if t, err = startTunnel(old); err != nil {
+				errs = append(errs, fmt.Errorf("tunnel %s: previous config: %v", name, err))
+				continue
+			}
+			t.log.Warn("Tunnel restarted with its previous config")
+		}
+		s.tunnels[name] = t
+	}
+	return errors.Join(errs...)
+}
+
+// retire stops t, its sessions drain in the background
+func (s *tunnelSet) retire(t *tunnel) {
+	t.close()
+	delete(s.tunnels, t.name)
+	s.retired = append(s.retired, t)
+}
+
+// shutdown stops every tunnel, and waits for the running streams to finish
+// up to the drain timeout before closing the sessions left
+func (s *tunnelSet) shutdown() {
+	s.lock.Lock()
+	for _, t := range s.tunnels {
+		s.retire(t)
+	}
+	retired := append([]*tunnel(nil), s.retired...)
+	deadline := time.Now().Add(s.drain)
+	s.lock.Unlock()
+
+	// drained without the lock, so the admin endpoint keeps answering, the
+	// drained tunnels are dropped by the next apply
+	for _, t := range retired {
+		t.drain(deadline)
+	}
+}
+
+// get returns the running tunnel named name
+func (s *tunnelSet) get(name string) *tunnel {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.tunnels[name]
+}
+
+// all returns the running tunnels by name, then the draining ones
+func (s *tunnelSet) all() []*tunnel {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	all := make([]*tunnel, 0, len(s.tunnels)+len(s.retired))
+	for _, t := range s.tunnels {
+		all = append(all, t)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].name < all[j].name })
+	return append(all, s.retired...)
+}
+
+// session returns the open session with id and its tunnel
+func (s *tunnelSet) session(id uint64) (*tunnel, *smux.Session) {
+	for _, t := range s.all() {
+		if session := t.session(id); session != nil {
+			return t, session
+		}
+	}
+	return nil, nil
+}
+
+// names returns the names of the running tunnels
+func (s *tunnelSet) names() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	names := make([]string, 0, len(s.tunnels))
+	for name := range s.tunnels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveNamed greets each connection accepted on l with name, then echoes it
+func serveNamed(l net.Listener, name string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			fmt.Fprintln(conn, name)
+			io.Copy(conn, conn)
+		}()
+	}
+}
+
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// greeting connects to addr and returns the connection with its first line
+func greeting(t *testing.T, addr string) (net.Conn, *bufio.Reader, string) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, r, line[:len(line)-1]
+}
+
+func TestReload(t *testing.T) {
+	var backends [2]string
+	for i, name := range []string{"a", "b"} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		go serveNamed(l, name)
+		backends[i] = l.Addr().String()
+	}
+	server, client, extra := freeAddr(t), freeAddr(t), freeAddr(t)
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	write := func(key, egress string, tunnels ...string) {
+		file := fmt.Sprintf(`{"key": %q, "tunnels": [
+			{"name": "server", "mode": "server", "ingress": %q, "egress": %q},
+			{"name": "client", "mode": "client", "ingress": %q, "egress": %q}`, key, server, egress, client, server)
+		for _, tunnel := range tunnels {
+			file += ", " + tunnel
+		}
+		if err := os.WriteFile(path, []byte(file+"]}"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	set := newTunnelSet([]string{"-c", path})
+	write(testKey, backends[0])
+	if err := set.reload(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, t := range set.tunnels {
+			t.close()
+		}
+	}()
+
+	conn, r, name := greeting(t, client)
+	defer conn.Close()
+	if name != "a" {
+		t.Fatalf("greeted by %q, want a", name)
+	}
+
+	// Rotate the key, move egress and add a tunnel
+	write("another-long-password-2", backends[1],
+		fmt.Sprintf(`{"name": "extra", "mode": "client", "ingress": %q, "egress": %q}`, extra, server))
+	if err := set.reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Running sessions and their streams are kept
+	fmt.Fprintln(conn, "ping")
+	if line, err := r.ReadString('\n'); err != nil || line != "ping\n" {
+		t.Fatalf("stream broken by reload: %q %v", line, err)
+	}
+	for _, addr := range []string{client, extra} {
+		conn, _, name := greeting(t, addr)
+		conn.Close()
+		if name != "b" {
+			t.Fatalf("greeted by %q on %s, want b", name, addr)
+		}
+	}
+
+	// Invalid configs leave the tunnels running
+	if err := os.WriteFile(path, []byte(`{"mode": "server"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := set.reload(); err == nil {
+		t.Fatal("invalid config applied")
+	}
+	if names := set.names(); len(names) != 3 {
+		t.Fatalf("tunnels %v after failed reload", names)
+	}
+
+	write("another-long-password-2", backends[1])
+	if err := set.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := net.Dial("tcp", extra); err == nil {
+		t.Fatal("removed tunnel still listening")
+	}
+
+	// A tunnel failing to restart keeps running with its previous config
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	running := client
+	client = busy.Addr().String()
+	write("another-long-password-2", backends[1])
+	if err := set.reload(); err == nil {
+		t.Fatal("tunnel started on a busy address")
+	}
+	conn, _, name = greeting(t, running)
+	conn.Close()
+	if name != "b" {
+		t.Fatalf("greeted by %q after failed restart, want b", name)
+	}
+}
+
+func TestShutdownDrain(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveNamed(l, "backend")
+	server, client := freeAddr(t), freeAddr(t)
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	file := fmt.Sprintf(`{"key": %q, "drain_timeout": 10, "tunnels": [
+		{"name": "server", "mode": "server", "ingress": %q, "egress": %q},
+		{"name": "client", "mode": "client", "ingress": %q, "egress": %q}]}`,
+		testKey, server, l.Addr(), client, server)
+	if err := os.WriteFile(path, []byte(file), 0600); err != nil {
+		t.Fatal(err)
+	}
+	set := newTunnelSet([]string{"-c", path})
+	if err := set.reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, r, _ := greeting(t, client)
+	defer conn.Close()
+	done := make(chan struct{})
+	go func() {
+		set.shutdown()
+		close(done)
+	}()
+
+	// Ingress stops accepting, the running stream is served until it ends
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c, err := net.Dial("tcp", client)
+		if err != nil {
+			break
+		}
+		c.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("ingress still accepting")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	fmt.Fprintln(conn, "ping")
+	if line, err := r.ReadString('\n'); err != nil || line != "ping\n" {
+		t.Fatalf("stream broken while draining: %q %v", line, err)
+	}
+	select {
+	case <-done:
+		t.Fatal("shutdown returned with a running stream")
+	default:
+	}
+	listed := make(chan []string)
+	go func() { listed <- set.names() }()
+	select {
+	case <-listed:
+	case <-time.After(time.Second):
+		t.Fatal("tunnels locked while draining")
+	}
+
+	conn.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sessions not closed once drained")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveNamed(l, "backend")
+	server, client, broken, brokenClient := freeAddr(t), freeAddr(t), freeAddr(t), freeAddr(t)
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	file := fmt.Sprintf(`{"key": %q, "tunnels": [
+		{"name": "m-server", "mode": "server", "ingress": %q, "egress": %q},
+		{"name": "m-client", "mode": "client", "ingress": %q, "egress": %q},
+		{"name": "m-broken", "mode": "server", "ingress": %q, "egress": %q},
+		{"name": "m-broken-client", "mode": "client", "ingress": %q, "egress": %q}]}`,
+		testKey, server, l.Addr(), client, server, broken, freeAddr(t), brokenClient, broken)
+	if err := os.WriteFile(path, []byte(file), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Counters are kept across runs of the test
+	failures := int(metricsFor("m-broken").DialFailures.Load())
+
+	set := newTunnelSet([]string{"-c", path})
+	if err := set.reload(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, t := range set.tunnels {
+			t.close()
+		}
+	}()
+
+	conn, _, _ := greeting(t, client)
+	defer conn.Close()
+	if c, err := net.Dial("tcp", brokenClient); err == nil {
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		io.Copy(io.Discard, c)
+		c.Close()
+	}
+
+	var buf strings.Builder
+	if err := writeMetrics(&buf, set); err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]int)
+	for _, line := range strings.Split(buf.String(), "\n") {
+		var name string
+		var value int
+		if _, err := fmt.Sscan(line, &name, &value); err == nil && !strings.HasPrefix(name, "#") {
+			values[name] = value
+		}
+	}
+	for name, want := range map[string]int{
+		`toriix_sessions{tunnel="m-server"}`:                             1,
+		`toriix_streams{tunnel="m-server"}`:                              1,
+		`toriix_dial_failures_total{tunnel="m-broken"}`:                  failures + 1,
+		`toriix_dial_failures_total{tunnel="m-server"}`:                  0,
+		`toriix_decrypt_failures_total{tunnel="m-server",part="header"}`: 0,
+	} {
+		if got, ok := values[name]; !ok || got != want {
+			t.Errorf("%s = %d, want %d", name, got, want)
+		}
+	}
+	for _, name := range []string{`toriix_bytes_total{tunnel="m-client",direction="out"}`, `toriix_frames_total{tunnel="m-server",direction="in"}`} {
+		if values[name] == 0 {
+			t.Errorf("%s not counted", name)
+		}
+	}
+	if t.Failed() {
+		t.Log(buf.String())
+	}
+}
+
+// adminCall requests path on the admin endpoint at addr and decodes the
+// response into v, returning the status code
+func adminCall(t *testing.T, method, addr, path string, v interface{}) int {
+	req, err := http.NewRequest(method, "http://"+addr+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(adminHeader, "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAdmin(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveNamed(l, "backend")
+	server, client, admin := freeAddr(t), freeAddr(t), freeAddr(t)
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	file := fmt.Sprintf(`{"key": %q, "tunnels": [
+		{"name": "a-server", "mode": "server", "ingress": %q, "egress": %q},
+		{"name": "a-client", "mode": "client", "ingress": %q, "egress": %q}]}`,
+		testKey, server, l.Addr(), client, server)
+	if err := os.WriteFile(path, []byte(file), 0600); err != nil {
+		t.Fatal(err)
+	}
+	set := newTunnelSet([]string{"-c", path})
+	if err := set.reload(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, t := range set.tunnels {
+			t.close()
+		}
+	}()
+	if err := serveAdmin(admin, 0600, set); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions := func(tunnel string) []sessionInfo {
+		var list []sessionInfo
+		if code := adminCall(t, "GET", admin, "/sessions?tunnel="+tunnel, &list); code != http.StatusOK {
+			t.Fatalf("GET /sessions: %d", code)
+		}
+		return list
+	}
+	// waitSession waits for a session of tunnel newer than old
+	waitSession := func(tunnel string, old uint64) sessionInfo {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			for _, s := range sessions(tunnel) {
+				if s.ID > old {
+					return s
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("no new session on %s", tunnel)
+		return sessionInfo{}
+	}
+
+	conn, r, _ := greeting(t, client)
+	defer conn.Close()
+	var tunnels []tunnelInfo
+	adminCall(t, "GET", admin, "/tunnels", &tunnels)
+	if len(tunnels) != 2 || tunnels[0].Name != "a-client" || tunnels[1].Sessions != 1 {
+		t.Fatalf("tunnels = %+v", tunnels)
+	}
+
+	// The forwarded connection is listed, and closed on request
+	srv := waitSession("a-server", 0)
+	if srv.Streams != 1 || srv.Remote == "" {
+		t.Errorf("session = %+v", srv)
+	}
+	var streams []streamInfo
+	adminCall(t, "GET", admin, fmt.Sprintf("/streams?session=%d", srv.ID), &streams)
+	if len(streams) != 1 || !streams[0].Peer || streams[0].Dst != l.Addr().String() || streams[0].BytesOut == 0 {
+		t.Fatalf("streams = %+v", streams)
+	}
+	if code := adminCall(t, "POST", admin, fmt.Sprintf("/streams/close?session=%d&id=%d", srv.ID, streams[0].ID), nil); code != http.StatusOK {
+		t.Fatalf("POST /streams/close: %d", code)
+	}
+	if _, err := r.ReadString('\n'); err == nil {
+		t.Error("closed stream still forwarding")
+	}
+
+	// Requests a browser could send cross-site are refused
+	for name, edit := range map[string]func(*http.Request){
+		"POST without " + adminHeader: func(req *http.Request) { req.Header.Del(adminHeader) },
+		"POST with a remote Host":     func(req *http.Request) { req.Host = "attacker.example:80" },
+	} {
+		req, _ := http.NewRequest("POST", "http://"+admin+"/tunnels/pause?name=a-client", nil)
+		req.Header.Set(adminHeader, "1")
+		edit(req)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: %d", name, resp.StatusCode)
+		}
+	}
+
+	// A paused tunnel refuses connections until resumed
+	if code := adminCall(t, "GET", admin, "/tunnels/pause?name=a-client", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /tunnels/pause: %d", code)
+	}
+	if code := adminCall(t, "POST", admin, "/tunnels/pause?name=nope", nil); code != http.StatusNotFound {
+		t.Errorf("pausing unknown tunnel: %d", code)
+	}
+	var info tunnelInfo
+	if adminCall(t, "POST", admin, "/tunnels/pause?name=a-client", &info); !info.Paused {
+		t.Errorf("tunnel = %+v", info)
+	}
+	if c, err := net.Dial("tcp", client); err == nil {
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := bufio.NewReader(c).ReadString('\n'); err == nil {
+			t.Error("paused tunnel forwarded a connection")
+		}
+		c.Close()
+	}
+	adminCall(t, "POST", admin, "/tunnels/resume?name=a-client", nil)
+	c, _, _ := greeting(t, client)
+	c.Close()
+
+	// Reconnecting sends GOAWAY and the client dials a new session, closing
+	// the session makes it dial again
+	cli := waitSession("a-client", 0)
+	adminCall(t, "POST", admin, "/tunnels/reconnect?name=a-client", nil)
+	next := waitSession("a-client", cli.ID)
+	c, _, _ = greeting(t, client)
+	c.Close()
+
+	if code := adminCall(t, "POST", admin, fmt.Sprintf("/sessions/close?id=%d", next.ID), nil); code != http.StatusOK {
+		t.Fatalf("POST /sessions/close: %d", code)
+	}
+	waitSession("a-client", next.ID)
+	if code := adminCall(t, "POST", admin, fmt.Sprintf("/sessions/close?id=%d", next.ID), nil); code != http.StatusNotFound {
+		t.Errorf("closing closed session: %d", code)
+	}
+	c, _, _ = greeting(t, client)
+	c.Close()
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/binary"
+	"github.com/ktcunreal/toriix/smux"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	maxDatagramSize   = 65535
+	defaultUDPTimeout = 60 * time.Second
+	udpQueueSize      = 128 // datagrams of a flow waiting for its stream
+)
+
+// Datagrams are carried over a stream as |2B length|payload|
+func writeDatagram(w io.Writer, b []byte) error {
+	buf := make([]byte, 2+len(b))
+	binary.LittleEndian.PutUint16(buf[:2], uint16(len(b)))
+	copy(buf[2:], b)
+	_, err := w.Write(buf)
+	return err
+}
+
+// readDatagram reads a single datagram into b, n is 0 if nothing has been
+// consumed from r when err is returned
+func readDatagram(r io.Reader, b []byte) (n int, err error) {
+	var l [2]byte
+	if n, err = io.ReadFull(r, l[:]); err != nil {
+		return n, err
+	}
+	size := int(binary.LittleEndian.Uint16(l[:]))
+	if _, err = io.ReadFull(r, b[:size]); err != nil {
+		return 2, err
+	}
+	return size, nil
+}
+
+// udpFlow relays datagrams of a single source address over a stream
+type udpFlow struct {
+	stream  *smux.Stream
+	timeout time.Duration
+	last    int64       // unix nano of last activity
+	queue   chan []byte // datagrams waiting to be sent, see sendQueued
+}
+
+func newUDPFlow(stream *smux.Stream, timeout time.Duration) *udpFlow {
+	f := &udpFlow{stream: stream, timeout: timeout}
+	f.touch()
+	return f
+}
+
+func (f *udpFlow) touch() {
+	atomic.StoreInt64(&f.last, time.Now().UnixNano())
+}
+
+func (f *udpFlow) idle() bool {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&f.last))) >= f.timeout
+}
+
+// send writes a datagram to the stream
+func (f *udpFlow) send(b []byte) error {
+	f.touch()
+	return writeDatagram(f.stream, b)
+}
+
+// enqueue hands a copy of b to sendQueued, it is dropped when the stream
+// does not keep up, as a full socket buffer would
+func (f *udpFlow) enqueue(b []byte) bool {
+	select {
+	case f.queue <- append([]byte(nil), b...):
+		return true
+	default:
+		return false
+	}
+}
+
+// sendQueued writes the queued datagrams to the stream until the queue is
+// closed, or a write fails
+func (f *udpFlow) sendQueued() error {
+	for b := range f.queue {
+		if err := f.send(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recv copies datagrams from the stream to write until the stream closes
+// or no datagram has been relayed in either direction for timeout
+func (f *udpFlow) recv(write func([]byte) error) error {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		f.stream.SetReadDeadline(time.Now().Add(f.timeout))
+		n, err := readDatagram(f.stream, buf)
+		if err == smux.ErrTimeout && n == 0 {
+			if f.idle() {
+				return nil
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		f.touch()
+		if err := write(buf[:n]); err != nil {
+			return err
+		}
+	}
+}
+
+// serveUDP maps each source address on pc to a stream until the session
+// closes or goes away, running flows carry on in the latter case. Datagrams
+// of new sources are dropped while paused. Each flow has its own queue, so
+// a stream out of window does not hold up the other sources.
+func serveUDP(pc net.PacketConn, session *smux.Session, timeout time.Duration, goAway <-chan struct{}, paused *atomic.Bool) error {
+	var flowLock sync.Mutex
+	flows := make(map[string]*udpFlow)
+
+	// unblock ReadFrom when session dies or goes away
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-session.CloseChan():
+			pc.SetReadDeadline(time.Now())
+		case <-session.GoAwayChan():
+			pc.SetReadDeadline(time.Now())
+		case <-goAway:
+			pc.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	defer pc.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-session.CloseChan():
+				return io.ErrClosedPipe
+			case <-session.GoAwayChan():
+				return smux.ErrGoAway
+			case <-goAway:
+				return smux.ErrGoAway
+			default:
+			}
+			return err
+		}
+
+		flowLock.Lock()
+		flow, ok := flows[addr.String()]
+		if !ok && paused.Load() {
+			flowLock.Unlock()
+			continue
+		}
+		if !ok {
+			stream, err := openStream(session, streamHeader{hdrNet: "udp", hdrSrc: addr.String()})
+			if err != nil {
+				flowLock.Unlock()
+				return err
+			}
+			flow = newUDPFlow(stream, timeout)
+			flow.queue = make(chan []byte, udpQueueSize)
+			flows[addr.String()] = flow
+
+			go func(addr net.Addr, flow *udpFlow) {
+				if err := flow.sendQueued(); err != nil {
+					flow.stream.Logger().Warn("Failed to relay datagram", "src", addr.String(), "err", err)
+					flow.stream.Close()
+				}
+			}(addr, flow)
+			go func(addr net.Addr, flow *udpFlow) {
+				defer func() {
+					flowLock.Lock()
+					delete(flows, addr.String())
+					close(flow.queue)
+					flowLock.Unlock()
+					flow.stream.Close()
+				}()
+				err := flow.recv(func(b []byte) error {
+					_, err := pc.WriteTo(b, addr)
+					return err
+				})
+				if err != nil && err != io.EOF {
+					flow.stream.Logger().Debug("Udp flow closed", "src", addr.String(), "err", err)
+				}
+			}(addr, flow)
+		}
+		if !flow.enqueue(buf[:n]) {
+			flow.stream.Logger().Debug("Udp flow queue full, datagram dropped", "src", addr.String())
+		}
+		flowLock.Unlock()
+	}
+}
+
+// relayUDP relays datagrams between a stream and a connected udp socket
+func relayUDP(stream *smux.Stream, conn net.Conn, timeout time.Duration) {
+	flow := newUDPFlow(stream, timeout)
+	go func() {
+		flow.recv(func(b []byte) error {
+			_, err := conn.Write(b)
+			return err
+		})
+		conn.Close()
+	}()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		n, err := conn.Read(buf)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && !flow.idle() {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		if err := flow.send(buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+func initPacketListener(addr string) (net.PacketConn, error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Listener started", "network", "udp", "addr", addr)
+	return pc, nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"github.com/ktcunreal/toriix/smux"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDatagramFraming(t *testing.T) {
+	var buf bytes.Buffer
+	sent := [][]byte{[]byte("first"), {}, bytes.Repeat([]byte{7}, maxDatagramSize)}
+	for _, b := range sent {
+		if err := writeDatagram(&buf, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := make([]byte, maxDatagramSize)
+	for _, want := range sent {
+		n, err := readDatagram(&buf, b)
+		if err != nil || !bytes.Equal(b[:n], want) {
+			t.Fatalf("read %d bytes, %v, want %d", n, err, len(want))
+		}
+	}
+	if n, err := readDatagram(&buf, b); n != 0 || err != io.EOF {
+		t.Errorf("at end: %d, %v", n, err)
+	}
+
+	// A datagram cut short consumed its length
+	writeDatagram(&buf, []byte("truncated"))
+	buf.Truncate(5)
+	if n, err := readDatagram(&buf, b); n == 0 || err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated: %d, %v", n, err)
+	}
+}
+
+// serveUDPEcho echoes datagrams received on pc
+func serveUDPEcho(pc net.PacketConn) {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		pc.WriteTo(buf[:n], addr)
+	}
+}
+
+func TestUDPForwarding(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go serveUDPEcho(echo)
+
+	client, server := sessionPair(t)
+	go acceptStreams(server, func(stream *smux.Stream, hdr streamHeader) {
+		if hdr[hdrNet] != "udp" {
+			t.Errorf("header = %v", hdr)
+			return
+		}
+		dst, err := net.Dial("udp", echo.LocalAddr().String())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer dst.Close()
+		relayUDP(stream, dst, time.Second)
+	})
+
+	ingress, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ingress.Close()
+	go serveUDP(ingress, client, time.Second, nil, new(atomic.Bool))
+
+	// Each source gets its own flow, and its own replies
+	for _, msg := range []string{"one", "two", "three"} {
+		src, err := net.Dial("udp", ingress.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer src.Close()
+		src.SetDeadline(time.Now().Add(5 * time.Second))
+		for i := 0; i < 2; i++ {
+			if _, err := src.Write([]byte(msg)); err != nil {
+				t.Fatal(err)
+			}
+			b := make([]byte, 64)
+			n, err := src.Read(b)
+			if err != nil || string(b[:n]) != msg {
+				t.Fatalf("reply = %q, %v, want %q", b[:n], err, msg)
+			}
+		}
+	}
+}
+
+func TestUDPFlowIsolation(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go serveUDPEcho(echo)
+
+	stuck, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stuck.Close()
+
+	// The stream of stuck is never read, its window runs out
+	conf := smux.DefaultConfig()
+	conf.Version = 2
+	client, server := sessionPairWith(t, conf)
+	done := make(chan struct{})
+	defer close(done)
+	go acceptStreams(server, func(stream *smux.Stream, hdr streamHeader) {
+		if hdr[hdrSrc] == stuck.LocalAddr().String() {
+			<-done
+			return
+		}
+		dst, err := net.Dial("udp", echo.LocalAddr().String())
+		if err != nil {
+			return
+		}
+		defer dst.Close()
+		relayUDP(stream, dst, time.Second)
+	})
+
+	ingress, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ingress.Close()
+	go serveUDP(ingress, client, time.Minute, nil, new(atomic.Bool))
+
+	b := make([]byte, 8192)
+	for i := 0; i < 200; i++ {
+		stuck.WriteTo(b, ingress.LocalAddr())
+		time.Sleep(100 * time.Microsecond)
+	}
+
+	src, err := net.Dial("udp", ingress.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	src.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := src.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	n, err := src.Read(b)
+	if err != nil || string(b[:n]) != "ping" {
+		t.Fatalf("reply = %q, %v", b[:n], err)
+	}
+}
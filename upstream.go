@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/net/proxy"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	upstreamHandshakeTimeout = 30 * time.Second
+)
+
+var (
+	ErrUpstreamUnsupported = errors.New("transport does not support upstream proxies")
+)
+
+func init() {
+	proxy.RegisterDialerType("http", newHTTPConnectDialer)
+}
+
+// newDialer returns a dialer connecting through the upstream proxy URL,
+// socks5://, socks5h:// or http:// with optional user:password, or
+// through forward when upstream is empty
+func newDialer(upstream string, forward proxy.Dialer) (proxy.Dialer, error) {
+	if upstream == "" {
+		return forward, nil
+	}
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream proxy: %v", err)
+	}
+	return proxy.FromURL(u, forward)
+}
+
+// httpConnectDialer tunnels connections through an http proxy with CONNECT
+type httpConnectDialer struct {
+	addr    string
+	auth    string // Proxy-Authorization header value, if any
+	forward proxy.Dialer
+}
+
+func newHTTPConnectDialer(u *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+	d := &httpConnectDialer{addr: u.Host, forward: forward}
+	if u.Port() == "" {
+		d.addr = net.JoinHostPort(u.Hostname(), "80")
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		creds := u.User.Username() + ":" + password
+		d.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(creds))
+	}
+	return d, nil
+}
+
+func (d *httpConnectDialer) Dial(network, addr string) (net.Conn, error) {
+	conn, err := d.forward.Dial("tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(upstreamHandshakeTimeout))
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if d.auth != "" {
+		req.Header.Set("Proxy-Authorization", d.auth)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("upstream proxy refused CONNECT to %s: %s", addr, resp.Status)
+	}
+
+	conn.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ktcunreal/toriix/smux"
+	"golang.org/x/net/proxy"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	minKeyLength = 20
+)
+
+// Validate checks the whole config and returns every problem found
+func (c *Config) Validate() error {
+	if len(c.Tunnels) == 0 {
+		return errors.Join(c.checkTunnel()...)
+	}
+
+	tunnels, err := c.tunnelConfigs()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	names := make(map[string]bool)
+	for i, t := range tunnels {
+		switch {
+		case t.Name == "":
+			errs = append(errs, fmt.Errorf("tunnels[%d].name: missing", i))
+		case names[t.Name]:
+			errs = append(errs, fmt.Errorf("tunnels[%d].name: duplicate name %q", i, t.Name))
+		}
+		names[t.Name] = true
+		for _, err := range t.checkTunnel() {
+			errs = append(errs, fmt.Errorf("tunnels[%d].%w", i, err))
+		}
+	}
+	if c.Admin != "" {
+		if err := checkLocalAddr(c.Admin); err != nil {
+			errs = append(errs, fmt.Errorf("admin: %v", err))
+		}
+	}
+	if c.Metrics != "" {
+		if err := checkLocalAddr(c.Metrics); err != nil {
+			errs = append(errs, fmt.Errorf("metrics: %v", err))
+		}
+	}
+	if c.DrainTimeout < 0 {
+		errs = append(errs, errors.New("drain_timeout: must not be negative"))
+	}
+	if err := checkLogFormat(c.LogFormat); err != nil {
+		errs = append(errs, fmt.Errorf("log_format: %v", err))
+	}
+	return errors.Join(errs...)
+}
+
+// checkTunnel returns the problems of the settings of a single tunnel
+func (c *Config) checkTunnel() []error {
+	var errs []error
+	add := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, a...))
+	}
+	check := func(key string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", key, err))
+		}
+	}
+
+	switch c.Mode {
+	case "server", "client":
+	case "":
+		add("mode: missing, server or client")
+	default:
+		add("mode: unknown mode %q, server or client", c.Mode)
+	}
+	check("key", checkKey(c.PSK))
+
+	// Reverse tunnel and binds only need the session address on each side
+	sessionOnly := len(c.Reverse)+len(c.Binds)+len(c.AllowBinds) > 0
+	if c.Ingress == "" && (c.Mode == "server" || !sessionOnly) {
+		add("ingress: missing")
+	}
+	if c.Egress == "" && (c.Mode == "client" || !sessionOnly) {
+		add("egress: missing")
+	}
+	if c.Ingress != "" {
+		check("ingress", checkAddr(c.Ingress))
+	}
+	if c.Egress != "" {
+		check("egress", checkAddr(c.Egress))
+	}
+	if c.Reverse != "" {
+		check("reverse", checkAddr(c.Reverse))
+	}
+
+	switch c.Network {
+	case "", "tcp":
+	case "udp":
+		if c.Proxy && c.Mode == "client" {
+			add("network: http proxy needs tcp ingress")
+		}
+	default:
+		add("network: unknown network %q, tcp or udp", c.Network)
+	}
+
+	for i, b := range c.Binds {
+		check(fmt.Sprintf("binds[%d].remote", i), checkAddr(b.Remote))
+		check(fmt.Sprintf("binds[%d].local", i), checkAddr(b.Local))
+	}
+	for i, entry := range c.AllowBinds {
+		check(fmt.Sprintf("allow_binds[%d]", i), checkBindPattern(entry))
+	}
+
+	if c.SocketMode != "" {
+		if _, err := strconv.ParseUint(c.SocketMode, 8, 32); err != nil {
+			add("socket_mode: %q is not an octal file mode", c.SocketMode)
+		}
+	}
+	if c.UDPTimeout < 0 {
+		add("udp_timeout: must not be negative")
+	}
+	if c.Paths < 0 {
+		add("paths: must not be negative")
+	}
+	if c.Resume < 0 {
+		add("resume: must not be negative")
+	}
+	if c.DrainTimeout < 0 {
+		add("drain_timeout: must not be negative")
+	}
+
+	if _, ok := transports[c.Transport]; c.Transport != "" && !ok {
+		add("transport: unknown transport %q, available: %v", c.Transport, transportNames())
+	}
+	if c.Transport == "kcp" && c.Upstream != "" {
+		add("upstream: %v", ErrUpstreamUnsupported)
+	}
+	if c.TLS != nil {
+		check("tls", c.TLS.validate())
+	}
+	if c.KCP != nil {
+		check("kcp", c.KCP.validate())
+	}
+
+	_, err := newDialer(c.Upstream, proxy.Direct)
+	check("upstream", err)
+	check("dial", c.Dial.validate())
+	check("proxy_protocol", checkProxyProtocol(c.ProxyProtocol))
+	check("smux", smux.VerifyConfig(c.smuxConfig()))
+	if c.Admin != "" {
+		check("admin", checkLocalAddr(c.Admin))
+	}
+	if c.Metrics != "" {
+		check("metrics", checkLocalAddr(c.Metrics))
+	}
+	check("log_format", checkLogFormat(c.LogFormat))
+	_, err = parseLogLevel(c.LogLevel)
+	check("log_level", err)
+	return errs
+}
+
+// checkKey rejects short keys and keys made of a single class of characters
+func checkKey(key string) error {
+	if key == "" {
+		return errors.New("missing")
+	}
+	if len(key) < minKeyLength {
+		return fmt.Errorf("must be at least %d characters", minKeyLength)
+	}
+
+	var lower, upper, digit, other bool
+	for _, r := range key {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	classes := 0
+	for _, ok := range []bool{lower, upper, digit, other} {
+		if ok {
+			classes++
+		}
+	}
+	if classes < 2 {
+		return errors.New("must mix letters, digits or symbols")
+	}
+	return nil
+}
+
+// checkAddr validates a host:port or unix: address
+func checkAddr(addr string) error {
+	if network, path := splitAddr(addr); network == "unix" {
+		if path == "" {
+			return errors.New("missing unix socket path")
+		}
+		return nil
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
+// checkLocalAddr validates the address of an endpoint without auth, which
+// must not be reachable from other hosts
+func checkLocalAddr(addr string) error {
+	if err := checkAddr(addr); err != nil {
+		return err
+	}
+	if network, _ := splitAddr(addr); network == "unix" {
+		return nil
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("%q is not a loopback address", host)
+	}
+	return nil
+}
+
+// checkLogFormat validates log_format
+func checkLogFormat(format string) error {
+	switch format {
+	case "", logText, logJSON:
+		return nil
+	}
+	return fmt.Errorf("unknown format %q, text or json", format)
+}
+
+// checkBindPattern validates an allow_binds entry, see bindAllowed
+func checkBindPattern(entry string) error {
+	_, ports, err := net.SplitHostPort(entry)
+	if err != nil {
+		return err
+	}
+	if ports == "*" {
+		return nil
+	}
+	lo, hi, ok := strings.Cut(ports, "-")
+	if !ok {
+		hi = lo
+	}
+	l, err1 := strconv.ParseUint(lo, 10, 16)
+	h, err2 := strconv.ParseUint(hi, 10, 16)
+	if err1 != nil || err2 != nil || l > h {
+		return fmt.Errorf("invalid port range %q", ports)
+	}
+	return nil
+}
+
+// validate checks the settings without loading certificate files
+func (t *TLSConfig) validate() error {
+	if (t.Cert == "") != (t.Key == "") {
+		return errors.New("cert and key must be set together")
+	}
+	if t.CA != "" {
+		if _, err := os.Stat(t.CA); err != nil {
+			return err
+		}
+	}
+	if t.Fingerprint != "" {
+		if _, err := parseFingerprint(t.Fingerprint); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (k *KCPConfig) validate() error {
+	if k.DataShards < 0 || k.ParityShards < 0 {
+		return errors.New("shards must not be negative")
+	}
+	if k.ParityShards > 0 && k.DataShards == 0 {
+		return errors.New("parity_shards needs data_shards")
+	}
+	if k.MTU <= 0 || k.SendWindow <= 0 || k.ReceiveWindow <= 0 || k.Interval <= 0 {
+		return errors.New("mtu, sndwnd, rcvwnd and interval must be positive")
+	}
+	return nil
+}
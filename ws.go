@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/gorilla/websocket"
+	"golang.org/x/net/proxy"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWSPath = "/"
+)
+
+var (
+	ErrListenerClosed = errors.New("listener closed")
+)
+
+// wsTransport carries sessions over binary websocket messages, so they can
+// pass through http-only networks and CDNs, and over wss when tls is configured
+type wsTransport struct {
+	path       string
+	host       string
+	mode       os.FileMode
+	dialer     proxy.Dialer
+	proxyProto bool
+
+	client *tls.Config
+	server *tls.Config
+}
+
+func init() {
+	registerTransport("ws", newWSTransport)
+}
+
+func newWSTransport(c *Config, log *slog.Logger) (Transport, error) {
+	dialer, err := newDialer(c.Upstream, proxy.Direct)
+	if err != nil {
+		return nil, err
+	}
+	t := &wsTransport{
+		path:       c.WSPath,
+		host:       c.WSHost,
+		mode:       c.socketMode(),
+		dialer:     dialer,
+		proxyProto: c.AcceptProxyProtocol,
+	}
+	if t.path == "" {
+		t.path = defaultWSPath
+	}
+	if c.TLS != nil {
+		var err error
+		if t.client, t.server, err = tlsConfigs(c, c.TLS, log); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// Dial connects to addr, sending the configured host and path in the
+// upgrade request
+func (t *wsTransport) Dial(addr string) (net.Conn, error) {
+	host := t.host
+	if host == "" {
+		host = addr
+		if network, _ := splitAddr(addr); network == "unix" {
+			host = "localhost"
+		}
+	}
+
+	dialer := &websocket.Dialer{
+		NetDial: func(string, string) (net.Conn, error) {
+			return dialVia(t.dialer, addr)
+		},
+		HandshakeTimeout: 30 * time.Second,
+	}
+	u := url.URL{Scheme: "ws", Host: host, Path: t.path}
+	if t.client != nil {
+		u.Scheme = "wss"
+		dialer.TLSClientConfig = clientConfigFor(t.client, host)
+	}
+	ws, _, err := dialer.Dial(u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return newWSConn(ws), nil
+}
+
+// Listen serves the upgrade path on an http server listening on addr
+func (t *wsTransport) Listen(addr string) (net.Listener, error) {
+	ln, err := listen(addr, t.mode)
+	if err != nil {
+		return nil, err
+	}
+	if t.proxyProto {
+		ln = &proxyProtoListener{ln}
+	}
+	if t.server != nil {
+		ln = tls.NewListener(ln, t.server)
+	}
+
+	l := newWSListener(ln.Addr(), t.path)
+	srv := &http.Server{Handler: l}
+	l.closer = srv
+	go srv.Serve(ln)
+	return l, nil
+}
+
+// wsListener is an http.Handler accepting websocket upgrades on path, it may
+// be mounted on any http server
+type wsListener struct {
+	addr     net.Addr
+	path     string
+	upgrader websocket.Upgrader
+	conns    chan net.Conn
+	closer   io.Closer
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+func newWSListener(addr net.Addr, path string) *wsListener {
+	return &wsListener{
+		addr:  addr,
+		path:  path,
+		conns: make(chan net.Conn),
+		die:   make(chan struct{}),
+	}
+}
+
+func (l *wsListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != l.path {
+		http.NotFound(w, r)
+		return
+	}
+
+	ws, err := l.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	select {
+	case l.conns <- newWSConn(ws):
+	case <-l.die:
+		ws.Close()
+	}
+}
+
+func (l *wsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.die:
+		return nil, ErrListenerClosed
+	}
+}
+
+func (l *wsListener) Close() error {
+	var err error
+	l.dieOnce.Do(func() {
+		close(l.die)
+		if l.closer != nil {
+			err = l.closer.Close()
+		}
+	})
+	return err
+}
+
+func (l *wsListener) Addr() net.Addr {
+	return l.addr
+}
+
+// wsConn turns the binary messages of a websocket into a net.Conn byte stream
+type wsConn struct {
+	*websocket.Conn
+	r     io.Reader
+	wlock sync.Mutex
+}
+
+func newWSConn(ws *websocket.Conn) *wsConn {
+	return &wsConn{Conn: ws}
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	for {
+		if c.r == nil {
+			mt, r, err := c.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if mt != websocket.BinaryMessage {
+				continue
+			}
+			c.r = r
+		}
+
+		n, err := c.r.Read(b)
+		if err == io.EOF {
+			c.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	if err := c.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}